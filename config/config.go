@@ -1,15 +1,29 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+const (
+	// maximumPieces is the largest number of pieces that the Reed-Solomon
+	// coding of Sia supports.
+	maximumPieces = 256
+
+	// minimumPageSize matches the block size of the NBD client, so that
+	// blocks never straddle two pages.
+	minimumPageSize = 4096
+)
+
 func PrependHomeDirectory(path string) string {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -49,3 +63,215 @@ func ReadPasswordFile(path string) (string, error) {
 
 	return strings.TrimSpace(string(passwordBytes)), nil
 }
+
+// LoadTLSConfig loads the server certificate and key. If a file with client
+// certificates is given, clients need to present a certificate signed by one
+// of them (or one of the certificates itself) to be allowed in.
+func LoadTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return &tlsConfig, nil
+	}
+
+	clientCAs, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(clientCAs) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	tlsConfig.ClientCAs = certPool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return &tlsConfig, nil
+}
+
+// Volume describes one export. Each volume is stored on Sia (or in another
+// remote store) under its own path prefix and keeps its cache in its own
+// subdirectory of the data directory.
+type Volume struct {
+	Name           string
+	Size           uint64
+	PageSize       uint64
+	SiaPathPrefix  string
+	CacheDirectory string
+	Store          string
+	Redundancy     Redundancy
+}
+
+// Redundancy describes how pages are erasure coded on Sia. An upload is
+// considered complete once it reaches the minimum redundancy.
+type Redundancy struct {
+	DataPieces   int
+	ParityPieces int
+	Minimum      float64
+}
+
+// Remote stores that a volume can be kept in. Volumes without a store use
+// the default store.
+const (
+	StoreSia   = "sia"
+	StoreS3    = "s3"
+	StoreLocal = "local"
+)
+
+// ParseVolume parses a volume specification of the form
+// name=NAME[,size=BYTES][,pagesize=BYTES][,prefix=SIAPATH][,cache=SUBDIRECTORY]
+// [,store=STORE][,data=PIECES][,parity=PIECES][,redundancy=MINIMUM]. Unless
+// given otherwise, the volume has the size, page size and redundancy of the
+// defaults, is stored under nbd/NAME in the default store and cached in the
+// subdirectory NAME.
+func ParseVolume(spec string, defaults Volume) (Volume, error) {
+	volume := Volume{
+		Size:       defaults.Size,
+		PageSize:   defaults.PageSize,
+		Redundancy: defaults.Redundancy,
+	}
+
+	prefixSet := false
+	cacheSet := false
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return Volume{}, fmt.Errorf("invalid volume field: %s", field)
+		}
+
+		key, value := parts[0], parts[1]
+		switch key {
+		case "name":
+			volume.Name = value
+		case "size", "pagesize":
+			size, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return Volume{}, fmt.Errorf("invalid volume %s: %s", key, value)
+			}
+
+			if key == "size" {
+				volume.Size = size
+			} else {
+				volume.PageSize = size
+			}
+		case "prefix":
+			volume.SiaPathPrefix = strings.Trim(value, "/")
+			prefixSet = true
+		case "cache":
+			volume.CacheDirectory = value
+			cacheSet = true
+		case "store":
+			if value != StoreSia && value != StoreS3 && value != StoreLocal {
+				return Volume{}, fmt.Errorf("unknown volume store: %s", value)
+			}
+			volume.Store = value
+		case "data", "parity":
+			pieces, err := strconv.Atoi(value)
+			if err != nil {
+				return Volume{}, fmt.Errorf("invalid number of %s pieces: %s", key, value)
+			}
+
+			if key == "data" {
+				volume.Redundancy.DataPieces = pieces
+			} else {
+				volume.Redundancy.ParityPieces = pieces
+			}
+		case "redundancy":
+			minimum, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Volume{}, fmt.Errorf("invalid minimum redundancy: %s", value)
+			}
+			volume.Redundancy.Minimum = minimum
+		default:
+			return Volume{}, fmt.Errorf("unknown volume field: %s", key)
+		}
+	}
+
+	if volume.Name == "" {
+		return Volume{}, fmt.Errorf("volume without name: %s", spec)
+	}
+
+	if !prefixSet {
+		volume.SiaPathPrefix = "nbd/" + volume.Name
+	}
+
+	if !cacheSet {
+		volume.CacheDirectory = volume.Name
+	}
+
+	if volume.SiaPathPrefix == "" || filepath.IsAbs(volume.CacheDirectory) ||
+		strings.HasPrefix(filepath.Clean(volume.CacheDirectory), "..") {
+		return Volume{}, fmt.Errorf("invalid location for volume %s", volume.Name)
+	}
+
+	return volume, nil
+}
+
+// CheckVolumes makes sure that volumes do not get in each other's way and
+// that their page size and redundancy settings are usable.
+func CheckVolumes(volumes []Volume) error {
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	cacheDirectories := map[string]bool{}
+
+	for _, volume := range volumes {
+		err := volume.Redundancy.Check()
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", volume.Name, err)
+		}
+
+		if volume.PageSize == 0 || volume.PageSize%minimumPageSize != 0 {
+			return fmt.Errorf("page size of volume %s is not a multiple of %d",
+				volume.Name, minimumPageSize)
+		}
+
+		cacheDirectory := filepath.Clean(volume.CacheDirectory)
+		switch {
+		case names[volume.Name]:
+			return fmt.Errorf("volume %s is defined twice", volume.Name)
+		case prefixes[volume.SiaPathPrefix]:
+			return fmt.Errorf("Sia path prefix %s is used twice", volume.SiaPathPrefix)
+		case cacheDirectories[cacheDirectory]:
+			return fmt.Errorf("cache directory %s is used twice", volume.CacheDirectory)
+		}
+
+		names[volume.Name] = true
+		prefixes[volume.SiaPathPrefix] = true
+		cacheDirectories[cacheDirectory] = true
+	}
+
+	return nil
+}
+
+// Maximum is the redundancy that an upload reaches once all pieces have been
+// uploaded.
+func (r Redundancy) Maximum() float64 {
+	return float64(r.DataPieces+r.ParityPieces) / float64(r.DataPieces)
+}
+
+// Check makes sure that the erasure coding is possible and that the minimum
+// redundancy can be reached. Sia itself might impose stricter limits.
+func (r Redundancy) Check() error {
+	if r.DataPieces < 1 || r.ParityPieces < 1 {
+		return errors.New("at least one data and one parity piece are required")
+	}
+
+	if r.DataPieces+r.ParityPieces > maximumPieces {
+		return fmt.Errorf("at most %d pieces are possible", maximumPieces)
+	}
+
+	if r.Minimum <= 0 || r.Minimum > r.Maximum() {
+		return fmt.Errorf("minimum redundancy %.2f is not between 0 and %.2f",
+			r.Minimum, r.Maximum())
+	}
+
+	return nil
+}
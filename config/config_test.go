@@ -0,0 +1,103 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testRedundancy = Redundancy{DataPieces: 10, ParityPieces: 20, Minimum: 2.5}
+	testDefaults   = Volume{Size: 1024, PageSize: 4096, Redundancy: testRedundancy}
+)
+
+func TestParseVolume(t *testing.T) {
+	volume, err := ParseVolume("name=backup", testDefaults)
+	assert.Nil(t, err)
+	expectedVolume := Volume{
+		Name:           "backup",
+		Size:           1024,
+		PageSize:       4096,
+		SiaPathPrefix:  "nbd/backup",
+		CacheDirectory: "backup",
+		Redundancy:     testRedundancy,
+	}
+	assert.Equal(t, expectedVolume, volume)
+
+	volume, err = ParseVolume("name=media,size=2048,prefix=/media/,cache=cache/media,store=s3",
+		testDefaults)
+	assert.Nil(t, err)
+	expectedVolume = Volume{
+		Name:           "media",
+		Size:           2048,
+		PageSize:       4096,
+		SiaPathPrefix:  "media",
+		CacheDirectory: "cache/media",
+		Store:          StoreS3,
+		Redundancy:     testRedundancy,
+	}
+	assert.Equal(t, expectedVolume, volume)
+
+	volume, err = ParseVolume("name=archive,data=10,parity=40,redundancy=4.5", testDefaults)
+	assert.Nil(t, err)
+	assert.Equal(t, Redundancy{DataPieces: 10, ParityPieces: 40, Minimum: 4.5}, volume.Redundancy)
+
+	volume, err = ParseVolume("name=archive,pagesize=8192", testDefaults)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192), volume.PageSize)
+
+	_, err = ParseVolume("name=archive,data=many", testDefaults)
+	assert.NotNil(t, err)
+
+	_, err = ParseVolume("size=2048", testDefaults)
+	assert.NotNil(t, err)
+
+	_, err = ParseVolume("name=media,size=big", testDefaults)
+	assert.NotNil(t, err)
+
+	_, err = ParseVolume("name=media,color=blue", testDefaults)
+	assert.NotNil(t, err)
+
+	_, err = ParseVolume("name=media,store=tape", testDefaults)
+	assert.NotNil(t, err)
+
+	_, err = ParseVolume("name=media,cache=../elsewhere", testDefaults)
+	assert.NotNil(t, err)
+}
+
+func TestCheckVolumes(t *testing.T) {
+	volumes := []Volume{
+		{Name: "sia", PageSize: 4096, SiaPathPrefix: "nbd", CacheDirectory: "",
+			Redundancy: testRedundancy},
+		{Name: "backup", PageSize: 4096, SiaPathPrefix: "nbd/backup", CacheDirectory: "backup",
+			Redundancy: testRedundancy},
+	}
+	assert.Nil(t, CheckVolumes(volumes))
+
+	volumes[1].SiaPathPrefix = "nbd"
+	assert.NotNil(t, CheckVolumes(volumes))
+
+	volumes[1].SiaPathPrefix = "nbd/backup"
+	volumes[1].CacheDirectory = "."
+	assert.NotNil(t, CheckVolumes(volumes))
+
+	volumes[1].CacheDirectory = "backup"
+	volumes[1].Redundancy.Minimum = 4
+	assert.NotNil(t, CheckVolumes(volumes))
+
+	volumes[1].Redundancy.Minimum = 2.5
+	volumes[1].PageSize = 5000
+	assert.NotNil(t, CheckVolumes(volumes))
+}
+
+func TestRedundancyCheck(t *testing.T) {
+	assert.Nil(t, testRedundancy.Check())
+	assert.Equal(t, 3.0, testRedundancy.Maximum())
+
+	assert.Nil(t, Redundancy{DataPieces: 10, ParityPieces: 20, Minimum: 3}.Check())
+	assert.NotNil(t, Redundancy{DataPieces: 10, ParityPieces: 20, Minimum: 3.1}.Check())
+	assert.NotNil(t, Redundancy{DataPieces: 10, ParityPieces: 20, Minimum: 0}.Check())
+	assert.NotNil(t, Redundancy{DataPieces: 0, ParityPieces: 20, Minimum: 1}.Check())
+	assert.NotNil(t, Redundancy{DataPieces: 10, ParityPieces: 0, Minimum: 1}.Check())
+	assert.NotNil(t, Redundancy{DataPieces: 100, ParityPieces: 200, Minimum: 2}.Check())
+}
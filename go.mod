@@ -1,6 +1,6 @@
 module github.com/javgh/sia-nbdserver
 
-go 1.12
+go 1.13
 
 require (
 	github.com/spf13/cobra v0.0.5
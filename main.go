@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -16,32 +18,101 @@ import (
 )
 
 const (
-	defaultSize                  = 1099511627776
-	defaultHardMaxCached         = 128
-	defaultSoftMaxCached         = 96
-	defaultIdleIntervalSeconds   = 120
-	defaultSiaDaemonAddress      = "localhost:9980"
-	defaultSiaPasswordFileSuffix = ".sia/apipassword"
+	defaultExportName               = "sia"
+	defaultSiaPathPrefix            = "nbd"
+	exportDescription               = "Sia storage + local cache"
+	defaultSize                     = 1099511627776
+	defaultPageSize                 = 67108864
+	defaultDirtyGranularity         = 4096
+	defaultHardMaxCached            = 128
+	defaultSoftMaxCached            = 96
+	defaultIdleIntervalSeconds      = 120
+	defaultDataPieces               = 10
+	defaultParityPieces             = 20
+	defaultMinimumRedundancy        = 2.5
+	defaultDrainTimeoutSeconds      = 30
+	defaultSiaDaemonAddress         = "localhost:9980"
+	defaultSiaPasswordFileSuffix    = ".sia/apipassword"
+	defaultLocalStoreLatencySeconds = 10
+	defaultS3Endpoint               = "https://s3.amazonaws.com"
+	defaultS3Region                 = "us-east-1"
 )
 
-func installSignalHandlers(siaBackend *sia.Backend) {
+// storeSettings holds everything needed to set up the remote store of a
+// volume.
+type storeSettings struct {
+	defaultStore     string
+	siaDaemonAddress string
+	siaPasswordFile  string
+	local            sia.LocalStoreSettings
+	s3               sia.S3StoreSettings
+}
+
+func (ss storeSettings) newStore(volume config.Volume) (sia.RemoteStore, error) {
+	store := volume.Store
+	if store == "" {
+		store = ss.defaultStore
+	}
+
+	switch store {
+	case config.StoreSia:
+		return sia.NewRenterStore(sia.RenterStoreSettings{
+			SiaDaemonAddress:  ss.siaDaemonAddress,
+			SiaPasswordFile:   ss.siaPasswordFile,
+			SiaPathPrefix:     volume.SiaPathPrefix,
+			DataPieces:        volume.Redundancy.DataPieces,
+			ParityPieces:      volume.Redundancy.ParityPieces,
+			MinimumRedundancy: volume.Redundancy.Minimum,
+		})
+	case config.StoreLocal:
+		if ss.local.Directory == "" {
+			return nil, fmt.Errorf("volume %s requires --local-store", volume.Name)
+		}
+
+		settings := ss.local
+		settings.Directory = filepath.Join(settings.Directory, volume.SiaPathPrefix)
+		settings.Redundancy = volume.Redundancy.Maximum()
+		return sia.NewLocalStore(settings)
+	case config.StoreS3:
+		settings := ss.s3
+		settings.Prefix = volume.SiaPathPrefix
+		return sia.NewS3Store(settings)
+	default:
+		panic("unknown store")
+	}
+}
+
+func installSignalHandlers(server *nbd.Server, drainTimeout time.Duration,
+	siaBackends []*sia.Backend) {
 	c := make(chan os.Signal, 3)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	for {
 		sig := <-c
+
+		// Clients are drained first, so that the backends
+		// only shut down once there are no more requests.
+		err := server.Shutdown(drainTimeout)
+		if err != nil {
+			log.Printf("%s\n", err)
+		}
+
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Printf("Performing fast shutdown\n")
-			err := siaBackend.Shutdown(false)
-			if err != nil {
-				log.Fatal(err)
+			for _, siaBackend := range siaBackends {
+				err := siaBackend.Shutdown(false)
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
 		case syscall.SIGUSR1:
 			log.Printf("Performing thorough shutdown\n")
-			err := siaBackend.Shutdown(true)
-			if err != nil {
-				log.Fatal(err)
+			for _, siaBackend := range siaBackends {
+				err := siaBackend.Shutdown(true)
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
 		default:
 			panic("unexpected signal")
@@ -49,30 +120,85 @@ func installSignalHandlers(siaBackend *sia.Backend) {
 	}
 }
 
-func serve(socketPath string, exportSize uint64, backendSettings sia.BackendSettings) {
-	siaBackend, err := sia.NewBackend(backendSettings)
+func serve(listenAddress string, tlsConfig *tls.Config, volumes []config.Volume,
+	backendSettings sia.BackendSettings, storeSettings storeSettings, drainTimeout time.Duration) {
+	ln, err := nbd.Listen(listenAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go installSignalHandlers(siaBackend)
+	siaBackends := []*sia.Backend{}
+	exports := []nbd.Export{}
+	for _, volume := range volumes {
+		log.Printf("Preparing volume %s\n", volume.Name)
+
+		store, err := storeSettings.newStore(volume)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		backendSettings.Size = volume.Size
+		backendSettings.PageSize = volume.PageSize
+		backendSettings.RemoteStore = store
+		backendSettings.MinimumRedundancy = volume.Redundancy.Minimum
+		backendSettings.CacheDirectory = config.PrependDataDirectory(volume.CacheDirectory)
+		siaBackend, err := sia.NewBackend(backendSettings)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		siaBackends = append(siaBackends, siaBackend)
+		exports = append(exports, nbd.Export{
+			Name:        volume.Name,
+			Description: exportDescription,
+			Size:        volume.Size,
+			ReadOnly:    backendSettings.ReadOnly,
+			Backend:     nbdBackend{siaBackend},
+		})
+	}
+
+	server := nbd.NewServer(ln, tlsConfig, exports)
+	go installSignalHandlers(server, drainTimeout, siaBackends)
 
-	err = nbd.Serve(socketPath, exportSize, siaBackend)
+	err = server.Serve()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	siaBackend.Wait()
+	for _, siaBackend := range siaBackends {
+		siaBackend.Wait()
+	}
 }
 
 func main() {
 	socketPath, _ := config.GetSocketPath()
+	listenAddress := ""
+	tlsCertFile := ""
+	tlsKeyFile := ""
+	tlsClientCAFile := ""
+	volumeSpecs := []string{}
+	readOnly := false
+	strictFUA := false
 	size := uint64(defaultSize)
+	pageSize := uint64(defaultPageSize)
+	dirtyGranularity := uint64(defaultDirtyGranularity)
 	hardMaxCached := defaultHardMaxCached
 	softMaxCached := defaultSoftMaxCached
 	idleIntervalSeconds := defaultIdleIntervalSeconds
+	redundancy := config.Redundancy{
+		DataPieces:   defaultDataPieces,
+		ParityPieces: defaultParityPieces,
+		Minimum:      defaultMinimumRedundancy,
+	}
+	drainTimeoutSeconds := defaultDrainTimeoutSeconds
 	siaDaemonAddress := defaultSiaDaemonAddress
 	siaPasswordFile := config.PrependHomeDirectory(defaultSiaPasswordFileSuffix)
+	localStoreDirectory := ""
+	localStoreLatencySeconds := defaultLocalStoreLatencySeconds
+	localStoreFailureRate := 0.0
+	s3Endpoint := defaultS3Endpoint
+	s3Bucket := ""
+	s3Region := defaultS3Region
 
 	rootDesc := "NBD server backed by Sia storage + local cache"
 	rootCmd := &cobra.Command{
@@ -80,41 +206,184 @@ func main() {
 		Short: rootDesc,
 		Long:  fmt.Sprintf("%s.", rootDesc),
 		Run: func(cmd *cobra.Command, args []string) {
-			if socketPath == "" {
-				fmt.Println("Default socket path is $XDG_RUNTIME_DIR/sia-nbdserver," +
-					" but $XDG_RUNTIME_DIR is not set. Please specify a socket path via -u flag.")
+			if listenAddress == "" {
+				if socketPath == "" {
+					fmt.Println("Default socket path is $XDG_RUNTIME_DIR/sia-nbdserver," +
+						" but $XDG_RUNTIME_DIR is not set. Please specify a socket path via -u flag.")
+					os.Exit(1)
+				}
+				listenAddress = "unix://" + socketPath
+			}
+
+			var tlsConfig *tls.Config
+			if tlsCertFile != "" || tlsKeyFile != "" {
+				var err error
+				tlsConfig, err = config.LoadTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else if tlsClientCAFile != "" {
+				fmt.Println("Client certificates require a server certificate and key" +
+					" (--tls-cert and --tls-key).")
 				os.Exit(1)
 			}
 
+			// Without any volumes given, there is a single one
+			// that is stored the same way as in earlier versions.
+			volumes := []config.Volume{{
+				Name:           defaultExportName,
+				Size:           size,
+				PageSize:       pageSize,
+				SiaPathPrefix:  defaultSiaPathPrefix,
+				CacheDirectory: "",
+				Redundancy:     redundancy,
+			}}
+			if len(volumeSpecs) > 0 {
+				defaults := volumes[0]
+				volumes = []config.Volume{}
+				for _, volumeSpec := range volumeSpecs {
+					volume, err := config.ParseVolume(volumeSpec, defaults)
+					if err != nil {
+						log.Fatal(err)
+					}
+					volumes = append(volumes, volume)
+				}
+			}
+
+			err := config.CheckVolumes(volumes)
+			if err != nil {
+				log.Fatal(err)
+			}
+
 			backendSettings := sia.BackendSettings{
-				Size:             size,
+				ReadOnly:         readOnly,
+				StrictSync:       strictFUA,
 				HardMaxCached:    hardMaxCached,
 				SoftMaxCached:    softMaxCached,
 				IdleInterval:     time.Duration(idleIntervalSeconds * int(time.Second)),
-				SiaDaemonAddress: siaDaemonAddress,
-				SiaPasswordFile:  siaPasswordFile,
+				DirtyGranularity: dirtyGranularity,
 			}
-			serve(socketPath, size, backendSettings)
+			drainTimeout := time.Duration(drainTimeoutSeconds * int(time.Second))
+			storeSettings := storeSettings{
+				defaultStore:     config.StoreSia,
+				siaDaemonAddress: siaDaemonAddress,
+				siaPasswordFile:  siaPasswordFile,
+				local: sia.LocalStoreSettings{
+					Directory:   localStoreDirectory,
+					Latency:     time.Duration(localStoreLatencySeconds * int(time.Second)),
+					FailureRate: localStoreFailureRate,
+				},
+				s3: sia.S3StoreSettings{
+					Endpoint:        s3Endpoint,
+					Bucket:          s3Bucket,
+					Region:          s3Region,
+					AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+					SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				},
+			}
+			if localStoreDirectory != "" {
+				storeSettings.defaultStore = config.StoreLocal
+			}
+			serve(listenAddress, tlsConfig, volumes, backendSettings, storeSettings, drainTimeout)
 		},
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&socketPath, "unix", "u", socketPath,
 		"unix domain socket")
+	rootCmd.PersistentFlags().StringVarP(&listenAddress, "listen", "l", listenAddress,
+		"address to listen on, e.g. tcp://0.0.0.0:10809 or unix:///path/to/socket; overrides -u")
+	rootCmd.PersistentFlags().StringVar(&tlsCertFile, "tls-cert", tlsCertFile,
+		"TLS server certificate; enables and requires TLS")
+	rootCmd.PersistentFlags().StringVar(&tlsKeyFile, "tls-key", tlsKeyFile,
+		"TLS server key")
+	rootCmd.PersistentFlags().StringVar(&tlsClientCAFile, "tls-client-ca", tlsClientCAFile,
+		"certificates to verify TLS clients against; enables client authentication")
+	rootCmd.PersistentFlags().StringArrayVar(&volumeSpecs, "volume", volumeSpecs,
+		"export a volume, given as name=NAME[,size=BYTES][,pagesize=BYTES][,prefix=SIAPATH][,cache=SUBDIRECTORY]"+
+			"[,store=sia|s3|local]"+
+			"[,data=PIECES][,parity=PIECES][,redundancy=MINIMUM];"+
+			" can be repeated, the first volume is the default")
+	rootCmd.PersistentFlags().BoolVar(&readOnly, "read-only", readOnly,
+		"export volumes read-only; no changes are made to the data on Sia")
+	rootCmd.PersistentFlags().BoolVar(&strictFUA, "strict-fua", strictFUA,
+		"acknowledge FUA writes only after the affected pages have been uploaded to Sia")
 	rootCmd.PersistentFlags().Uint64VarP(&size, "size", "s", size,
-		"size of block device; should ideally be a multiple of 67108864 (2 ^ 26)")
+		"size of block device; should ideally be a multiple of the page size")
+	rootCmd.PersistentFlags().Uint64Var(&pageSize, "page-size", pageSize,
+		"size of the pages that are stored on Sia; can not be changed once a volume has been created")
+	rootCmd.PersistentFlags().Uint64Var(&dirtyGranularity, "dirty-granularity", dirtyGranularity,
+		"size of the blocks in which changes to a page are tracked; needs to divide the page size")
 	rootCmd.PersistentFlags().IntVarP(&hardMaxCached, "hard", "H", hardMaxCached,
-		"hard limit for number of 64 MiB pages in the cache")
+		"hard limit for number of pages in the cache")
 	rootCmd.PersistentFlags().IntVarP(&softMaxCached, "soft", "S", softMaxCached,
-		"soft limit for number of 64 MiB pages in the cache")
+		"soft limit for number of pages in the cache")
 	rootCmd.PersistentFlags().IntVarP(&idleIntervalSeconds, "idle", "i", idleIntervalSeconds,
 		"seconds to wait before a cache page is marked idle and upload begins")
+	rootCmd.PersistentFlags().IntVar(&redundancy.DataPieces, "data-pieces", redundancy.DataPieces,
+		"number of data pieces for uploads to Sia, unless a volume says otherwise")
+	rootCmd.PersistentFlags().IntVar(&redundancy.ParityPieces, "parity-pieces", redundancy.ParityPieces,
+		"number of parity pieces for uploads to Sia, unless a volume says otherwise")
+	rootCmd.PersistentFlags().Float64Var(&redundancy.Minimum, "min-redundancy", redundancy.Minimum,
+		"redundancy at which an upload to Sia is complete, unless a volume says otherwise")
+	rootCmd.PersistentFlags().IntVar(&drainTimeoutSeconds, "drain-timeout", drainTimeoutSeconds,
+		"seconds to wait for clients to finish their requests on shutdown")
 	rootCmd.PersistentFlags().StringVar(&siaPasswordFile, "sia-password-file", siaPasswordFile,
 		"path to Sia API password file")
 	rootCmd.PersistentFlags().StringVar(&siaDaemonAddress, "sia-daemon", siaDaemonAddress,
 		"host and port of Sia daemon")
 
+	rootCmd.PersistentFlags().StringVar(&localStoreDirectory, "local-store", localStoreDirectory,
+		"store pages in this local directory instead of on Sia unless a volume says otherwise;"+
+			" for development and testing")
+	rootCmd.PersistentFlags().IntVar(&localStoreLatencySeconds, "local-store-latency",
+		localStoreLatencySeconds, "seconds that downloads and uploads take with --local-store")
+	rootCmd.PersistentFlags().Float64Var(&localStoreFailureRate, "local-store-failure-rate",
+		localStoreFailureRate, "probability that an operation fails with --local-store")
+	rootCmd.PersistentFlags().StringVar(&s3Endpoint, "s3-endpoint", s3Endpoint,
+		"URL of S3-compatible object storage for volumes with store=s3")
+	rootCmd.PersistentFlags().StringVar(&s3Bucket, "s3-bucket", s3Bucket,
+		"bucket for volumes with store=s3; credentials are taken from $AWS_ACCESS_KEY_ID"+
+			" and $AWS_SECRET_ACCESS_KEY")
+	rootCmd.PersistentFlags().StringVar(&s3Region, "s3-region", s3Region,
+		"region of the S3 bucket")
+
 	err := rootCmd.Execute()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// nbdBackend adapts a sia.Backend to the nbd package, which has its own types
+// for extents.
+type nbdBackend struct {
+	*sia.Backend
+}
+
+func (nb nbdBackend) Extents(offset int64, length int) []nbd.Extent {
+	extents := []nbd.Extent{}
+	for _, extent := range nb.Backend.Extents(offset, length) {
+		extents = append(extents, nbd.Extent{
+			Length: extent.Length,
+			Zero:   extent.Zero,
+			Cache:  asNBDCacheState(extent.Cache),
+		})
+	}
+	return extents
+}
+
+func asNBDCacheState(cacheState sia.CacheState) nbd.CacheState {
+	switch cacheState {
+	case sia.CacheStateZero:
+		return nbd.CacheStateZero
+	case sia.CacheStateNotCached:
+		return nbd.CacheStateNotCached
+	case sia.CacheStateCachedUnchanged:
+		return nbd.CacheStateCachedUnchanged
+	case sia.CacheStateCachedChanged:
+		return nbd.CacheStateCachedChanged
+	case sia.CacheStateCachedUploading:
+		return nbd.CacheStateCachedUploading
+	default:
+		panic("unknown cache state")
+	}
+}
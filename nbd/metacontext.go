@@ -0,0 +1,163 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+type (
+	metaContext struct {
+		name  string
+		flags func(extent Extent) uint32
+	}
+
+	nbdBlockDescriptor struct {
+		NbdExtentLength uint32
+		NbdStatusFlags  uint32
+	}
+
+	nbdExtendedBlockDescriptor struct {
+		NbdExtentLength uint64
+		NbdStatusFlags  uint64
+	}
+)
+
+const (
+	nbdStateHole = 1 << 0
+	nbdStateZero = 1 << 1
+)
+
+// The index of a meta context in this list doubles as its context ID.
+var metaContexts = []metaContext{
+	{
+		name: "base:allocation",
+		flags: func(extent Extent) uint32 {
+			if extent.Zero {
+				return nbdStateHole | nbdStateZero
+			}
+			return 0
+		},
+	},
+	{
+		name: "sia:cache",
+		flags: func(extent Extent) uint32 {
+			return uint32(extent.Cache)
+		},
+	},
+}
+
+// parseMetaContextOption parses the option data of NBD_OPT_LIST_META_CONTEXT
+// and NBD_OPT_SET_META_CONTEXT into the export name and the list of queries.
+func parseMetaContextOption(optionData []byte) (string, []string, error) {
+	reader := bytes.NewReader(optionData)
+
+	exportName, err := readString(reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var queryCount uint32
+	err = binary.Read(reader, binary.BigEndian, &queryCount)
+	if err != nil {
+		return "", nil, err
+	}
+
+	queries := []string{}
+	for i := uint32(0); i < queryCount; i++ {
+		query, err := readString(reader)
+		if err != nil {
+			return "", nil, err
+		}
+		queries = append(queries, query)
+	}
+
+	if reader.Len() > 0 {
+		return "", nil, errors.New("unexpected trailing option data")
+	}
+
+	return exportName, queries, nil
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	var length uint32
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+
+	if int64(length) > int64(reader.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// matchMetaContexts returns the IDs of all meta contexts that match at least
+// one of the queries. A query ending in a colon matches a whole namespace. No
+// queries at all match every context when listing, but none when setting.
+func matchMetaContexts(queries []string, listing bool) []uint32 {
+	ids := []uint32{}
+	for id, context := range metaContexts {
+		matches := listing && len(queries) == 0
+		for _, query := range queries {
+			if query == context.name ||
+				(strings.HasSuffix(query, ":") && strings.HasPrefix(context.name, query)) {
+				matches = true
+			}
+		}
+
+		if matches {
+			ids = append(ids, uint32(id))
+		}
+	}
+	return ids
+}
+
+// blockDescriptors converts the extents reported by the backend into block
+// descriptors for the given meta context, merging neighbours with identical
+// flags.
+func blockDescriptors(contextID uint32, extents []Extent, onlyOne bool) []nbdExtendedBlockDescriptor {
+	descriptors := []nbdExtendedBlockDescriptor{}
+	for _, extent := range extents {
+		flags := uint64(metaContexts[contextID].flags(extent))
+
+		if len(descriptors) > 0 && descriptors[len(descriptors)-1].NbdStatusFlags == flags {
+			descriptors[len(descriptors)-1].NbdExtentLength += uint64(extent.Length)
+			continue
+		}
+
+		descriptors = append(descriptors, nbdExtendedBlockDescriptor{
+			NbdExtentLength: uint64(extent.Length),
+			NbdStatusFlags:  flags,
+		})
+	}
+
+	if onlyOne && len(descriptors) > 1 {
+		descriptors = descriptors[:1]
+	}
+
+	return descriptors
+}
+
+// narrowBlockDescriptors converts block descriptors for clients without
+// extended headers. Requests are limited to 32 bits in that case, so the
+// lengths always fit.
+func narrowBlockDescriptors(descriptors []nbdExtendedBlockDescriptor) []nbdBlockDescriptor {
+	narrowDescriptors := []nbdBlockDescriptor{}
+	for _, descriptor := range descriptors {
+		narrowDescriptors = append(narrowDescriptors, nbdBlockDescriptor{
+			NbdExtentLength: uint32(descriptor.NbdExtentLength),
+			NbdStatusFlags:  uint32(descriptor.NbdStatusFlags),
+		})
+	}
+	return narrowDescriptors
+}
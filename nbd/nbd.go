@@ -1,11 +1,16 @@
 package nbd
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +19,50 @@ type (
 		Available() bool
 		ReadAt(buf []byte, offset int64) (int, error)
 		WriteAt(buf []byte, offset int64) (int, error)
+		Flush() error
+		Sync(offset int64, length int) error
+		Prefetch(offset int64, length int) error
+		Trim(offset int64, length int) error
+		WriteZeroes(offset int64, length int, noHole bool) error
+		Extents(offset int64, length int) []Extent
+		PageSize() int
+	}
+
+	// Extent describes a contiguous range of the export. Zero is set for
+	// ranges that have never been written and therefore read as zeroes.
+	// Cache tells where the data of the range currently lives.
+	Extent struct {
+		Length int
+		Zero   bool
+		Cache  CacheState
+	}
+
+	CacheState uint32
+
+	// Export is a block device offered to clients under the given name.
+	// Clients are not allowed to make changes to a read-only export.
+	Export struct {
+		Name        string
+		Description string
+		Size        uint64
+		ReadOnly    bool
+		Backend     Backend
+	}
+
+	connection struct {
+		server               *Server
+		conn                 net.Conn
+		writer               *bufio.Writer
+		writeMutex           *sync.Mutex
+		tlsConfig            *tls.Config
+		tlsActive            bool
+		exports              []Export
+		exportSize           uint64
+		readOnly             bool
+		backend              Backend
+		structuredReplies    bool
+		extendedHeaders      bool
+		selectedMetaContexts []uint32
 	}
 
 	nbdNewStyleHeader struct {
@@ -43,6 +92,13 @@ type (
 		NbdTransmissionFlags uint16
 	}
 
+	nbdRepInfoBlockSize struct {
+		NbdRepInfoType        uint16
+		NbdMinimumBlockSize   uint32
+		NbdPreferredBlockSize uint32
+		NbdMaximumBlockSize   uint32
+	}
+
 	nbdRequest struct {
 		NbdRequestMagic uint32
 		NbdCommandFlags uint16
@@ -52,11 +108,58 @@ type (
 		NbdLength       uint32
 	}
 
+	// nbdExtendedRequest is used instead of nbdRequest once extended headers
+	// have been negotiated. Internally, all requests are handled in this form.
+	nbdExtendedRequest struct {
+		NbdRequestMagic uint32
+		NbdCommandFlags uint16
+		NbdCommandType  uint16
+		NbdHandle       uint64
+		NbdOffset       uint64
+		NbdLength       uint64
+	}
+
 	nbdSimpleReply struct {
 		NbdSimpleReplyMagic uint32
 		NbdError            uint32
 		NbdHandle           uint64
 	}
+
+	nbdStructuredReplyChunk struct {
+		NbdStructuredReplyMagic  uint32
+		NbdStructuredReplyFlags  uint16
+		NbdStructuredReplyType   uint16
+		NbdHandle                uint64
+		NbdStructuredReplyLength uint32
+	}
+
+	nbdExtendedReplyChunk struct {
+		NbdExtendedReplyMagic  uint32
+		NbdExtendedReplyFlags  uint16
+		NbdExtendedReplyType   uint16
+		NbdHandle              uint64
+		NbdOffset              uint64
+		NbdExtendedReplyLength uint64
+	}
+
+	nbdReplyOffsetHole struct {
+		NbdOffset   uint64
+		NbdHoleSize uint32
+	}
+
+	nbdReplyErrorHeader struct {
+		NbdError         uint32
+		NbdMessageLength uint16
+	}
+)
+
+// These values are reported as flags in the "sia:cache" meta context.
+const (
+	CacheStateZero CacheState = iota
+	CacheStateNotCached
+	CacheStateCachedUnchanged
+	CacheStateCachedChanged
+	CacheStateCachedUploading
 )
 
 const (
@@ -65,311 +168,499 @@ const (
 	nbdOptionReplyMagic = 0x3e889045565a9
 	nbdRequestMagic     = 0x25609513
 	nbdSimpleReplyMagic = 0x67446698
+	nbdStructuredMagic  = 0x668e33ef
+
+	nbdExtendedRequestMagic = 0x21e41c71
+	nbdExtendedReplyMagic   = 0x6e8a278c
 
 	nbdFlagFixedNewstyle = 1 << 0
 
 	nbdFlagCFixedNewstyle = 1 << 0
 
-	nbdOptAbort = 2
-	nbdOptList  = 3
-	nbdOptGo    = 7
-
-	nbdRepAck      = 1
-	nbdRepServer   = 2
-	nbdRepInfo     = 3
-	nbdRepErrUnsup = 1<<31 + 1
-
-	nbdInfoExport = 0
-
-	nbdFlagHasFlags = 1 << 0
+	nbdOptAbort           = 2
+	nbdOptList            = 3
+	nbdOptStartTLS        = 5
+	nbdOptInfo            = 6
+	nbdOptGo              = 7
+	nbdOptStructuredReply = 8
+	nbdOptListMetaContext = 9
+	nbdOptSetMetaContext  = 10
+	nbdOptExtendedHeaders = 11
+
+	nbdRepAck         = 1
+	nbdRepServer      = 2
+	nbdRepInfo        = 3
+	nbdRepMetaContext = 4
+	nbdRepErrUnsup    = 1<<31 + 1
+	nbdRepErrInvalid  = 1<<31 + 3
+	nbdRepErrTLSReqd  = 1<<31 + 5
+	nbdRepErrUnknown  = 1<<31 + 6
+
+	nbdInfoExport      = 0
+	nbdInfoName        = 1
+	nbdInfoDescription = 2
+	nbdInfoBlockSize   = 3
+
+	nbdFlagHasFlags        = 1 << 0
+	nbdFlagReadOnly        = 1 << 1
+	nbdFlagSendFlush       = 1 << 2
+	nbdFlagSendFUA         = 1 << 3
+	nbdFlagSendTrim        = 1 << 5
+	nbdFlagSendWriteZeroes = 1 << 6
+	nbdFlagCanMultiConn    = 1 << 8
+	nbdFlagSendCache       = 1 << 10
+
+	// Flushes are handled by the backend as a whole, so a flush on one
+	// connection also covers writes that were completed on another one.
+	// This allows clients to open multiple connections.
+	transmissionFlags = nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA |
+		nbdFlagSendTrim | nbdFlagSendWriteZeroes | nbdFlagCanMultiConn | nbdFlagSendCache
+
+	nbdCmdFlagFUA    = 1 << 0
+	nbdCmdFlagNoHole = 1 << 1
+	nbdCmdFlagReqOne = 1 << 3
+
+	nbdCmdRead        = 0
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdTrim        = 4
+	nbdCmdCache       = 5
+	nbdCmdWriteZeroes = 6
+	nbdCmdBlockStatus = 7
+
+	nbdReplyFlagDone = 1 << 0
+
+	nbdReplyTypeNone           = 0
+	nbdReplyTypeOffsetData     = 1
+	nbdReplyTypeOffsetHole     = 2
+	nbdReplyTypeBlockStatus    = 5
+	nbdReplyTypeBlockStatusExt = 6
+	nbdReplyTypeError          = 1<<15 + 1
+	nbdReplyTypeErrorOffset    = 1<<15 + 2
+
+	nbdEPERM     = 1
+	nbdEIO       = 5
+	nbdENOMEM    = 12
+	nbdEINVAL    = 22
+	nbdENOSPC    = 28
+	nbdEOVERFLOW = 75
+	nbdENOTSUP   = 95
+	nbdESHUTDOWN = 108
+
+	maxErrorMessageLength = 4096
+	maxOptionLength       = 65536
+	maxRequestLength      = 268435456
+	maxBufferedLength     = 2 * maxRequestLength
+	workerCount           = 16
 
-	nbdCmdRead  = 0
-	nbdCmdWrite = 1
-	nbdCmdDisc  = 2
-
-	maxOptionLength  = 65536
-	maxRequestLength = 268435456
-
-	exportName        = "sia"
 	interruptInterval = 2 * time.Second
+
+	// Requests can be of any size, but clients should prefer
+	// the block size of typical filesystems.
+	minimumBlockSize   = 1
+	preferredBlockSize = 4096
 )
 
-func handle(conn net.Conn, exportSize uint64, backend Backend) error {
+// negotiate performs the handshake phase. It returns false if the client
+// aborted the handshake instead of entering the transmission phase.
+func (c *connection) negotiate() (bool, error) {
 	newStyleHeader := nbdNewStyleHeader{
 		NbdMagic:          nbdMagic,
 		NbdOptionMagic:    nbdOptionMagic,
 		NbdHandshakeFlags: nbdFlagFixedNewstyle,
 	}
 
-	err := binary.Write(conn, binary.BigEndian, newStyleHeader)
+	err := c.send(newStyleHeader)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	var clientFlags nbdClientFlags
-	err = binary.Read(conn, binary.BigEndian, &clientFlags)
+	err = binary.Read(c.conn, binary.BigEndian, &clientFlags)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// We will be picky and require the client to have
 	// set NBD_FLAG_C_FIXED_NEWSTYLE even though it only SHOULD
 	// do so according to the protocol specification.
 	if clientFlags != nbdFlagCFixedNewstyle {
-		err = conn.Close()
+		err = c.conn.Close()
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		return errors.New("unexpected client flags")
+		return false, errors.New("unexpected client flags")
 	}
 
-	handshakeOngoing := true
-	for handshakeOngoing {
+	for {
 		var clientOption nbdClientOption
-		err = binary.Read(conn, binary.BigEndian, &clientOption)
+		err = binary.Read(c.conn, binary.BigEndian, &clientOption)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		if clientOption.NbdOptionMagic != nbdOptionMagic {
-			return errors.New("did not receive option magic")
+			return false, errors.New("did not receive option magic")
 		}
 
 		if clientOption.NbdOptionLength > maxOptionLength {
-			return errors.New("option is too long")
+			return false, errors.New("option is too long")
 		}
 
 		optionData := make([]byte, clientOption.NbdOptionLength)
 		if clientOption.NbdOptionLength > 0 {
-			_, err = io.ReadFull(conn, optionData)
+			_, err = io.ReadFull(c.conn, optionData)
 			if err != nil {
-				return err
+				return false, err
 			}
 		}
 
+		// If TLS is configured, it is mandatory.
+		tlsRequired := c.tlsConfig != nil && !c.tlsActive &&
+			clientOption.NbdOptionID != nbdOptStartTLS && clientOption.NbdOptionID != nbdOptAbort
+		if tlsRequired {
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrTLSReqd, nil)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
 		switch clientOption.NbdOptionID {
-		case nbdOptList:
-			optionReply := nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepServer,
-				NbdOptionReplyLength: uint32(4 /* length of export name as uint32 */ + len(exportName)),
+		case nbdOptStartTLS:
+			if c.tlsConfig == nil {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrUnsup, nil)
+				if err != nil {
+					return false, err
+				}
+				break
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
-			if err != nil {
-				return err
+
+			if c.tlsActive || clientOption.NbdOptionLength > 0 {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrInvalid, nil)
+				if err != nil {
+					return false, err
+				}
+				break
 			}
 
-			err = binary.Write(conn, binary.BigEndian, uint32(len(exportName)))
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepAck, nil)
 			if err != nil {
-				return err
+				return false, err
 			}
 
-			err = binary.Write(conn, binary.BigEndian, []byte(exportName))
+			tlsConn := tls.Server(c.conn, c.tlsConfig)
+			err = tlsConn.Handshake()
 			if err != nil {
-				return err
+				return false, err
 			}
 
-			optionReply = nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepAck,
-				NbdOptionReplyLength: 0,
+			c.conn = tlsConn
+			c.writer = bufio.NewWriter(tlsConn)
+			c.tlsActive = true
+		case nbdOptList:
+			for _, export := range c.exports {
+				payload := make([]byte, 4 /* length of export name as uint32 */)
+				binary.BigEndian.PutUint32(payload, uint32(len(export.Name)))
+				payload = append(payload, export.Name...)
+
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepServer, payload)
+				if err != nil {
+					return false, err
+				}
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepAck, nil)
 			if err != nil {
-				return err
+				return false, err
 			}
-		case nbdOptAbort:
-			optionReply := nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepAck,
-				NbdOptionReplyLength: 0,
+		case nbdOptStructuredReply:
+			replyType := uint32(nbdRepAck)
+			if clientOption.NbdOptionLength > 0 {
+				replyType = nbdRepErrInvalid
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+
+			err = c.sendOptionReply(clientOption.NbdOptionID, replyType, nil)
 			if err != nil {
-				return err
+				return false, err
 			}
-			return nil
-		case nbdOptGo:
-			// We won't process the option data that the client
-			// sent along. The export name doesn't matter and
-			// dealing with any information requests the client may have
-			// is not implemented.
-
-			// send NBD_INFO_EXPORT
-			optionReply := nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepInfo,
-				NbdOptionReplyLength: 12, // size of nbdRepInfoPayload struct
+
+			c.structuredReplies = replyType == nbdRepAck
+		case nbdOptExtendedHeaders:
+			replyType := uint32(nbdRepAck)
+			if clientOption.NbdOptionLength > 0 {
+				replyType = nbdRepErrInvalid
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+
+			err = c.sendOptionReply(clientOption.NbdOptionID, replyType, nil)
 			if err != nil {
-				return err
+				return false, err
 			}
 
-			infoPayload := nbdRepInfoPayload{
-				NbdRepInfoType:       nbdInfoExport,
-				NbdExportSize:        exportSize,
-				NbdTransmissionFlags: nbdFlagHasFlags,
+			// Extended headers imply structured replies.
+			if replyType == nbdRepAck {
+				c.extendedHeaders = true
+				c.structuredReplies = true
 			}
-			err = binary.Write(conn, binary.BigEndian, infoPayload)
+		case nbdOptListMetaContext, nbdOptSetMetaContext:
+			isSet := clientOption.NbdOptionID == nbdOptSetMetaContext
+
+			// The meta contexts are the same for every export, but
+			// the name still has to refer to one of them.
+			name, queries, parseErr := parseMetaContextOption(optionData)
+			if parseErr != nil || (isSet && !c.structuredReplies) {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrInvalid, nil)
+				if err != nil {
+					return false, err
+				}
+				break
+			}
+
+			if _, ok := c.findExport(name); !ok {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrUnknown, nil)
+				if err != nil {
+					return false, err
+				}
+				break
+			}
+
+			ids := matchMetaContexts(queries, !isSet)
+			for _, id := range ids {
+				payload := make([]byte, 4 /* context ID as uint32 */)
+				binary.BigEndian.PutUint32(payload, id)
+				payload = append(payload, metaContexts[id].name...)
+
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepMetaContext, payload)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			if isSet {
+				c.selectedMetaContexts = ids
+			}
+
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepAck, nil)
 			if err != nil {
-				return err
+				return false, err
+			}
+		case nbdOptAbort:
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepAck, nil)
+			if err != nil {
+				return false, err
+			}
+			return false, nil
+		case nbdOptInfo, nbdOptGo:
+			name, infoRequests, parseErr := parseInfoOption(optionData)
+			if parseErr != nil {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrInvalid, nil)
+				if err != nil {
+					return false, err
+				}
+				break
 			}
 
-			// send NBD_REP_ACK
-			optionReply = nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepAck,
-				NbdOptionReplyLength: 0,
+			export, ok := c.findExport(name)
+			if !ok {
+				err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrUnknown, nil)
+				if err != nil {
+					return false, err
+				}
+				break
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+
+			err = c.sendExportInfo(clientOption.NbdOptionID, export, infoRequests)
 			if err != nil {
-				return err
+				return false, err
+			}
+
+			// send NBD_REP_ACK
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepAck, nil)
+			if err != nil {
+				return false, err
 			}
 
-			// entering transmission phase now
-			handshakeOngoing = false
+			if clientOption.NbdOptionID == nbdOptGo {
+				c.exportSize = export.Size
+				c.readOnly = export.ReadOnly
+				c.backend = export.Backend
+
+				// entering transmission phase now
+				return true, nil
+			}
 		default:
 			// reply with 'not supported' for everything else
-			optionReply := nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepErrUnsup,
-				NbdOptionReplyLength: 0,
-			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+			err = c.sendOptionReply(clientOption.NbdOptionID, nbdRepErrUnsup, nil)
 			if err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
+}
 
-	buf := make([]byte, 0)
-	transmissionOngoing := true
-	for transmissionOngoing {
-		var request nbdRequest
-		err = binary.Read(conn, binary.BigEndian, &request)
-		if err != nil {
-			return err
-		}
+// findExport looks up an export by name. The empty name refers to the first
+// export, which acts as the default.
+func (c *connection) findExport(name string) (Export, bool) {
+	if name == "" && len(c.exports) > 0 {
+		return c.exports[0], true
+	}
 
-		if request.NbdRequestMagic != nbdRequestMagic {
-			return errors.New("did not receive request magic")
+	for _, export := range c.exports {
+		if export.Name == name {
+			return export, true
 		}
+	}
+	return Export{}, false
+}
 
-		if request.NbdLength > maxRequestLength {
-			return errors.New("request is too large")
-		}
+func (e Export) transmissionFlags() uint16 {
+	if e.ReadOnly {
+		return transmissionFlags | nbdFlagReadOnly
+	}
+	return transmissionFlags
+}
 
-		if int(request.NbdLength) > cap(buf) {
-			// increase buffer capacity as needed
-			buf = make([]byte, request.NbdLength)
-		}
-		buf = buf[0:request.NbdLength]
+// sendExportInfo always sends NBD_INFO_EXPORT, followed by any other
+// information the client asked for.
+func (c *connection) sendExportInfo(optionID uint32, export Export, infoRequests []uint16) error {
+	optionReply := nbdOptionReply{
+		NbdOptionReplyMagic:  nbdOptionReplyMagic,
+		NbdOptionID:          optionID,
+		NbdOptionReplyType:   nbdRepInfo,
+		NbdOptionReplyLength: 12, // size of nbdRepInfoPayload struct
+	}
+	infoPayload := nbdRepInfoPayload{
+		NbdRepInfoType:       nbdInfoExport,
+		NbdExportSize:        export.Size,
+		NbdTransmissionFlags: export.transmissionFlags(),
+	}
+	err := c.send(optionReply, infoPayload)
+	if err != nil {
+		return err
+	}
 
-		switch request.NbdCommandType {
-		case nbdCmdRead:
-			_, err := backend.ReadAt(buf, int64(request.NbdOffset))
-			if err != nil {
-				// Taking some liberty with error handling
-				// and just disconnecting here.
-				return err
+	for _, infoRequest := range infoRequests {
+		switch infoRequest {
+		case nbdInfoName, nbdInfoDescription:
+			text := export.Name
+			if infoRequest == nbdInfoDescription {
+				text = export.Description
 			}
 
-			reply := nbdSimpleReply{
-				NbdSimpleReplyMagic: nbdSimpleReplyMagic,
-				NbdError:            0,
-				NbdHandle:           request.NbdHandle,
-			}
-			err = binary.Write(conn, binary.BigEndian, reply)
-			if err != nil {
-				return err
-			}
+			payload := make([]byte, 2 /* info type as uint16 */)
+			binary.BigEndian.PutUint16(payload, infoRequest)
+			payload = append(payload, text...)
 
-			err = binary.Write(conn, binary.BigEndian, buf)
+			err = c.sendOptionReply(optionID, nbdRepInfo, payload)
 			if err != nil {
 				return err
 			}
-		case nbdCmdWrite:
-			_, err = io.ReadFull(conn, buf)
-			if err != nil {
-				return err
+		case nbdInfoBlockSize:
+			// Requests should ideally not cross page boundaries.
+			preferred := preferredBlockSize
+			if export.Backend.PageSize() < preferred {
+				preferred = export.Backend.PageSize()
 			}
 
-			_, err := backend.WriteAt(buf, int64(request.NbdOffset))
-			if err != nil {
-				// Taking some liberty with error handling
-				// and just disconnecting here.
-				return err
+			optionReply.NbdOptionReplyLength = 14 // size of nbdRepInfoBlockSize struct
+			blockSizePayload := nbdRepInfoBlockSize{
+				NbdRepInfoType:        nbdInfoBlockSize,
+				NbdMinimumBlockSize:   minimumBlockSize,
+				NbdPreferredBlockSize: uint32(preferred),
+				NbdMaximumBlockSize:   maxRequestLength,
 			}
-
-			reply := nbdSimpleReply{
-				NbdSimpleReplyMagic: nbdSimpleReplyMagic,
-				NbdError:            0,
-				NbdHandle:           request.NbdHandle,
-			}
-			err = binary.Write(conn, binary.BigEndian, reply)
+			err = c.send(optionReply, blockSizePayload)
 			if err != nil {
 				return err
 			}
-		case nbdCmdDisc:
-			transmissionOngoing = false
 		}
 	}
 
 	return nil
 }
 
-func Serve(socketPath string, exportSize uint64, backend Backend) error {
-	unixAddr, err := net.ResolveUnixAddr("unix", socketPath)
+// parseInfoOption parses the option data of NBD_OPT_INFO and NBD_OPT_GO into
+// the export name and the list of information requests.
+func parseInfoOption(optionData []byte) (string, []uint16, error) {
+	reader := bytes.NewReader(optionData)
+
+	name, err := readString(reader)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	ln, err := net.ListenUnix("unix", unixAddr)
+	var requestCount uint16
+	err = binary.Read(reader, binary.BigEndian, &requestCount)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	log.Printf("Server listens at %s - connect with:\n", socketPath)
-	log.Printf("  # modprobe nbd\n")
-	log.Printf("  # nbd-client -b 4096 -u %s /dev/nbd0\n", socketPath)
 
-	for backend.Available() {
-		// Wake up from Accept() periodically to
-		// check if we need to shutdown the server.
-		ln.SetDeadline(time.Now().Add(interruptInterval))
-		conn, err := ln.Accept()
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				continue
-			}
-			return err
-		}
-		log.Printf("Client connected")
+	infoRequests := make([]uint16, requestCount)
+	err = binary.Read(reader, binary.BigEndian, infoRequests)
+	if err != nil {
+		return "", nil, err
+	}
 
-		err = handle(conn, exportSize, backend)
-		if err != nil {
-			log.Printf("Client disconnected with error: %s", err)
+	if reader.Len() > 0 {
+		return "", nil, errors.New("unexpected trailing option data")
+	}
+
+	return name, infoRequests, nil
+}
+
+// send writes all parts to the connection in one go. Replies to concurrently
+// processed requests are serialized this way.
+func (c *connection) send(parts ...interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for _, part := range parts {
+		var err error
+		if data, ok := part.([]byte); ok {
+			_, err = c.writer.Write(data)
 		} else {
-			log.Printf("Client disconnected")
+			err = binary.Write(c.writer, binary.BigEndian, part)
 		}
 
-		err = conn.Close()
 		if err != nil {
 			return err
 		}
 	}
 
-	err = ln.Close()
-	if err != nil {
-		return err
+	return c.writer.Flush()
+}
+
+func (c *connection) sendOptionReply(optionID uint32, replyType uint32, payload []byte) error {
+	optionReply := nbdOptionReply{
+		NbdOptionReplyMagic:  nbdOptionReplyMagic,
+		NbdOptionID:          optionID,
+		NbdOptionReplyType:   replyType,
+		NbdOptionReplyLength: uint32(len(payload)),
 	}
+	return c.send(optionReply, payload)
+}
 
-	return nil
+// Listen creates a listener for an address of the form unix:///path/to/socket
+// or tcp://host:port.
+func Listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		unixAddr, err := net.ResolveUnixAddr("unix", strings.TrimPrefix(address, "unix://"))
+		if err != nil {
+			return nil, err
+		}
+
+		return net.ListenUnix("unix", unixAddr)
+	case strings.HasPrefix(address, "tcp://"):
+		tcpAddr, err := net.ResolveTCPAddr("tcp", strings.TrimPrefix(address, "tcp://"))
+		if err != nil {
+			return nil, err
+		}
+
+		return net.ListenTCP("tcp", tcpAddr)
+	default:
+		return nil, fmt.Errorf("unsupported listen address: %s", address)
+	}
 }
@@ -0,0 +1,1190 @@
+package nbd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPageSize   = 4096
+	testExportSize = 4 * testPageSize
+	testExportName = "test"
+	testExportDesc = "test export"
+)
+
+type memBackend struct {
+	data    []byte
+	written []bool
+	syncs   int
+	cached  []bool
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		data:    make([]byte, testExportSize),
+		written: make([]bool, testExportSize/testPageSize),
+		cached:  make([]bool, testExportSize/testPageSize),
+	}
+}
+
+func (mb *memBackend) Available() bool {
+	return true
+}
+
+func (mb *memBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	return copy(buf, mb.data[offset:]), nil
+}
+
+func (mb *memBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	for i := offset / testPageSize; i <= (offset+int64(len(buf))-1)/testPageSize; i++ {
+		mb.written[i] = true
+	}
+	return copy(mb.data[offset:], buf), nil
+}
+
+func (mb *memBackend) Flush() error {
+	return nil
+}
+
+func (mb *memBackend) Sync(offset int64, length int) error {
+	mb.syncs += 1
+	return nil
+}
+
+func (mb *memBackend) Prefetch(offset int64, length int) error {
+	for i := offset / testPageSize; i <= (offset+int64(length)-1)/testPageSize; i++ {
+		mb.cached[i] = true
+	}
+	return nil
+}
+
+func (mb *memBackend) Trim(offset int64, length int) error {
+	return nil
+}
+
+func (mb *memBackend) WriteZeroes(offset int64, length int, noHole bool) error {
+	_, err := mb.WriteAt(make([]byte, length), offset)
+	return err
+}
+
+func (mb *memBackend) PageSize() int {
+	return testPageSize
+}
+
+func (mb *memBackend) Extents(offset int64, length int) []Extent {
+	extents := []Extent{}
+	for length > 0 {
+		page := offset / testPageSize
+		extentLength := int(testPageSize - offset%testPageSize)
+		if extentLength > length {
+			extentLength = length
+		}
+
+		isZero := !mb.written[page]
+		cacheState := CacheStateCachedChanged
+		if isZero {
+			cacheState = CacheStateZero
+		}
+
+		if len(extents) > 0 && extents[len(extents)-1].Zero == isZero {
+			extents[len(extents)-1].Length += extentLength
+		} else {
+			extents = append(extents, Extent{Length: extentLength, Zero: isZero, Cache: cacheState})
+		}
+
+		offset += int64(extentLength)
+		length -= extentLength
+	}
+	return extents
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func connect(t *testing.T, backend Backend) *testClient {
+	return connectWithTLS(t, nil, backend)
+}
+
+func connectWithTLS(t *testing.T, tlsConfig *tls.Config, backend Backend) *testClient {
+	export := Export{
+		Name:        testExportName,
+		Description: testExportDesc,
+		Size:        testExportSize,
+		Backend:     backend,
+	}
+	return connectToExports(t, tlsConfig, []Export{export})
+}
+
+func connectToExports(t *testing.T, tlsConfig *tls.Config, exports []Export) *testClient {
+	return connectToServer(t, NewServer(nil, tlsConfig, exports))
+}
+
+func connectToServer(t *testing.T, server *Server) *testClient {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		server.handle(serverConn)
+		serverConn.Close()
+	}()
+
+	return handshake(t, clientConn)
+}
+
+// dial connects to a server that is listening on the given listener.
+func dial(t *testing.T, ln net.Listener) *testClient {
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handshake(t, conn)
+}
+
+func handshake(t *testing.T, clientConn net.Conn) *testClient {
+	var header nbdNewStyleHeader
+	err := binary.Read(clientConn, binary.BigEndian, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(nbdMagic), header.NbdMagic)
+
+	err = binary.Write(clientConn, binary.BigEndian, nbdClientFlags(nbdFlagCFixedNewstyle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{t: t, conn: clientConn}
+}
+
+func (tc *testClient) sendOption(optionID uint32, data []byte) {
+	option := nbdClientOption{
+		NbdOptionMagic:  nbdOptionMagic,
+		NbdOptionID:     optionID,
+		NbdOptionLength: uint32(len(data)),
+	}
+	err := binary.Write(tc.conn, binary.BigEndian, option)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	if len(data) == 0 {
+		return
+	}
+
+	_, err = tc.conn.Write(data)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) readOptionReply() (nbdOptionReply, []byte) {
+	var reply nbdOptionReply
+	err := binary.Read(tc.conn, binary.BigEndian, &reply)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	data := make([]byte, reply.NbdOptionReplyLength)
+	_, err = io.ReadFull(tc.conn, data)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return reply, data
+}
+
+// goToTransmission sends NBD_OPT_GO and skips over the replies until the
+// final acknowledgement.
+func (tc *testClient) goToTransmission() {
+	tc.sendOption(nbdOptGo, []byte{0, 0, 0, 0, 0, 0})
+	for {
+		reply, _ := tc.readOptionReply()
+		if reply.NbdOptionReplyType == nbdRepAck {
+			return
+		}
+		assert.Equal(tc.t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	}
+}
+
+func (tc *testClient) sendRequest(commandType uint16, handle uint64, offset uint64, length uint32) {
+	tc.sendRequestWithFlags(commandType, 0, handle, offset, length)
+}
+
+func (tc *testClient) sendRequestWithFlags(commandType uint16, flags uint16, handle uint64,
+	offset uint64, length uint32) {
+	request := nbdRequest{
+		NbdRequestMagic: nbdRequestMagic,
+		NbdCommandFlags: flags,
+		NbdCommandType:  commandType,
+		NbdHandle:       handle,
+		NbdOffset:       offset,
+		NbdLength:       length,
+	}
+	err := binary.Write(tc.conn, binary.BigEndian, request)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) readSimpleReply() nbdSimpleReply {
+	var reply nbdSimpleReply
+	err := binary.Read(tc.conn, binary.BigEndian, &reply)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	assert.Equal(tc.t, uint32(nbdSimpleReplyMagic), reply.NbdSimpleReplyMagic)
+	return reply
+}
+
+func (tc *testClient) readChunk() (nbdStructuredReplyChunk, []byte) {
+	var chunk nbdStructuredReplyChunk
+	err := binary.Read(tc.conn, binary.BigEndian, &chunk)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	assert.Equal(tc.t, uint32(nbdStructuredMagic), chunk.NbdStructuredReplyMagic)
+
+	payload := make([]byte, chunk.NbdStructuredReplyLength)
+	_, err = io.ReadFull(tc.conn, payload)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return chunk, payload
+}
+
+func (tc *testClient) sendExtendedRequest(commandType uint16, handle uint64, offset uint64,
+	length uint64) {
+	request := nbdExtendedRequest{
+		NbdRequestMagic: nbdExtendedRequestMagic,
+		NbdCommandType:  commandType,
+		NbdHandle:       handle,
+		NbdOffset:       offset,
+		NbdLength:       length,
+	}
+	err := binary.Write(tc.conn, binary.BigEndian, request)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) readExtendedChunk() (nbdExtendedReplyChunk, []byte) {
+	var chunk nbdExtendedReplyChunk
+	err := binary.Read(tc.conn, binary.BigEndian, &chunk)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	assert.Equal(tc.t, uint32(nbdExtendedReplyMagic), chunk.NbdExtendedReplyMagic)
+
+	payload := make([]byte, chunk.NbdExtendedReplyLength)
+	_, err = io.ReadFull(tc.conn, payload)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return chunk, payload
+}
+
+func TestSimpleReadWrite(t *testing.T) {
+	tc := connect(t, newMemBackend())
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdWrite, 1, 100, 3)
+	_, err := tc.conn.Write([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply.NbdHandle)
+	assert.Equal(t, uint32(0), reply.NbdError)
+
+	tc.sendRequest(nbdCmdRead, 2, 99, 5)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(2), reply.NbdHandle)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(tc.conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0, 1, 2, 3, 0}, buf)
+
+	tc.sendRequest(nbdCmdDisc, 3, 0, 0)
+}
+
+func TestForceUnitAccess(t *testing.T) {
+	backend := newMemBackend()
+	tc := connect(t, backend)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdWrite, 1, 0, 1)
+	_, err := tc.conn.Write([]byte{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	assert.Equal(t, 0, backend.syncs)
+
+	tc.sendRequestWithFlags(nbdCmdWrite, nbdCmdFlagFUA, 2, 0, 1)
+	_, err = tc.conn.Write([]byte{43})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	assert.Equal(t, 1, backend.syncs)
+
+	tc.sendRequestWithFlags(nbdCmdTrim, nbdCmdFlagFUA, 3, 0, testPageSize)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	assert.Equal(t, 2, backend.syncs)
+
+	tc.sendRequest(nbdCmdDisc, 4, 0, 0)
+}
+
+func TestCache(t *testing.T) {
+	backend := newMemBackend()
+	tc := connect(t, backend)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdCache, 1, testPageSize, testPageSize+1)
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	assert.Equal(t, []bool{false, true, true, false}, backend.cached)
+
+	tc.sendRequest(nbdCmdCache, 2, testExportSize, 1)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint32(nbdEINVAL), reply.NbdError)
+
+	tc.sendRequest(nbdCmdDisc, 3, 0, 0)
+}
+
+func TestStructuredRead(t *testing.T) {
+	backend := newMemBackend()
+	_, err := backend.WriteAt([]byte{42}, testPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := connect(t, backend)
+	tc.sendOption(nbdOptStructuredReply, nil)
+	reply, _ := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdRead, 7, 0, 3*testPageSize)
+
+	chunk, payload := tc.readChunk()
+	assert.Equal(t, uint16(nbdReplyTypeOffsetHole), chunk.NbdStructuredReplyType)
+	assert.Equal(t, uint16(0), chunk.NbdStructuredReplyFlags)
+	assert.Equal(t, uint64(7), chunk.NbdHandle)
+	assert.Equal(t, uint64(0), binary.BigEndian.Uint64(payload[0:8]))
+	assert.Equal(t, uint32(testPageSize), binary.BigEndian.Uint32(payload[8:12]))
+
+	chunk, payload = tc.readChunk()
+	assert.Equal(t, uint16(nbdReplyTypeOffsetData), chunk.NbdStructuredReplyType)
+	assert.Equal(t, uint16(0), chunk.NbdStructuredReplyFlags)
+	assert.Equal(t, uint64(testPageSize), binary.BigEndian.Uint64(payload[0:8]))
+	assert.Equal(t, testPageSize, len(payload[8:]))
+	assert.Equal(t, byte(42), payload[8])
+
+	chunk, payload = tc.readChunk()
+	assert.Equal(t, uint16(nbdReplyTypeOffsetHole), chunk.NbdStructuredReplyType)
+	assert.Equal(t, uint16(nbdReplyFlagDone), chunk.NbdStructuredReplyFlags)
+	assert.Equal(t, uint64(2*testPageSize), binary.BigEndian.Uint64(payload[0:8]))
+
+	tc.sendRequest(nbdCmdDisc, 8, 0, 0)
+}
+
+func metaContextOptionData(exportName string, queries ...string) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(exportName)))
+	data = append(data, exportName...)
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(queries)))
+	data = append(data, count...)
+
+	for _, query := range queries {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(query)))
+		data = append(data, length...)
+		data = append(data, query...)
+	}
+	return data
+}
+
+func infoOptionData(exportName string, infoRequests ...uint16) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(exportName)))
+	data = append(data, exportName...)
+
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(infoRequests)))
+	data = append(data, count...)
+
+	for _, infoRequest := range infoRequests {
+		request := make([]byte, 2)
+		binary.BigEndian.PutUint16(request, infoRequest)
+		data = append(data, request...)
+	}
+	return data
+}
+
+func TestInfo(t *testing.T) {
+	tc := connect(t, newMemBackend())
+
+	tc.sendOption(nbdOptInfo, infoOptionData("",
+		nbdInfoName, nbdInfoDescription, nbdInfoBlockSize))
+
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, uint16(nbdInfoExport), binary.BigEndian.Uint16(payload[0:2]))
+	assert.Equal(t, uint64(testExportSize), binary.BigEndian.Uint64(payload[2:10]))
+
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, uint16(nbdInfoName), binary.BigEndian.Uint16(payload[0:2]))
+	assert.Equal(t, testExportName, string(payload[2:]))
+
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, uint16(nbdInfoDescription), binary.BigEndian.Uint16(payload[0:2]))
+	assert.Equal(t, testExportDesc, string(payload[2:]))
+
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, 14, len(payload))
+	assert.Equal(t, uint16(nbdInfoBlockSize), binary.BigEndian.Uint16(payload[0:2]))
+	assert.Equal(t, uint32(minimumBlockSize), binary.BigEndian.Uint32(payload[2:6]))
+	assert.Equal(t, uint32(testPageSize), binary.BigEndian.Uint32(payload[6:10]))
+	assert.Equal(t, uint32(maxRequestLength), binary.BigEndian.Uint32(payload[10:14]))
+
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	// malformed option data is rejected
+	tc.sendOption(nbdOptInfo, []byte{0, 0, 0, 0, 0})
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrInvalid), reply.NbdOptionReplyType)
+
+	// NBD_OPT_INFO does not end the negotiation
+	tc.goToTransmission()
+	tc.sendRequest(nbdCmdRead, 1, 0, 1)
+	simpleReply := tc.readSimpleReply()
+	assert.Equal(t, uint32(0), simpleReply.NbdError)
+	_, err := io.ReadFull(tc.conn, make([]byte, 1))
+	assert.Nil(t, err)
+
+	tc.sendRequest(nbdCmdDisc, 2, 0, 0)
+}
+
+func TestMultipleExports(t *testing.T) {
+	first := newMemBackend()
+	second := newMemBackend()
+	_, err := second.WriteAt([]byte{42}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exports := []Export{
+		{Name: "first", Size: testExportSize, Backend: first},
+		{Name: "second", Size: 2 * testPageSize, Backend: second},
+	}
+	tc := connectToExports(t, nil, exports)
+
+	tc.sendOption(nbdOptList, nil)
+	for _, export := range exports {
+		reply, payload := tc.readOptionReply()
+		assert.Equal(t, uint32(nbdRepServer), reply.NbdOptionReplyType)
+		assert.Equal(t, uint32(len(export.Name)), binary.BigEndian.Uint32(payload[0:4]))
+		assert.Equal(t, export.Name, string(payload[4:]))
+	}
+	reply, _ := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptInfo, infoOptionData("unknown"))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrUnknown), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptListMetaContext, metaContextOptionData("unknown"))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrUnknown), reply.NbdOptionReplyType)
+
+	// the empty name selects the first export
+	tc.sendOption(nbdOptInfo, infoOptionData(""))
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, uint64(testExportSize), binary.BigEndian.Uint64(payload[2:10]))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptGo, infoOptionData("second"))
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	assert.Equal(t, uint64(2*testPageSize), binary.BigEndian.Uint64(payload[2:10]))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendRequest(nbdCmdRead, 1, 0, 1)
+	simpleReply := tc.readSimpleReply()
+	assert.Equal(t, uint32(0), simpleReply.NbdError)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(tc.conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(42), buf[0])
+
+	tc.sendRequest(nbdCmdDisc, 2, 0, 0)
+}
+
+func TestReadOnly(t *testing.T) {
+	export := Export{
+		Name:     testExportName,
+		Size:     testExportSize,
+		ReadOnly: true,
+		Backend:  newMemBackend(),
+	}
+	tc := connectToExports(t, nil, []Export{export})
+
+	tc.sendOption(nbdOptGo, infoOptionData(""))
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepInfo), reply.NbdOptionReplyType)
+	flags := binary.BigEndian.Uint16(payload[10:12])
+	assert.Equal(t, uint16(nbdFlagReadOnly), flags&nbdFlagReadOnly)
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendRequest(nbdCmdWrite, 1, 0, 1)
+	_, err := tc.conn.Write([]byte{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleReply := tc.readSimpleReply()
+	assert.Equal(t, uint32(nbdEPERM), simpleReply.NbdError)
+
+	tc.sendRequest(nbdCmdTrim, 2, 0, testPageSize)
+	simpleReply = tc.readSimpleReply()
+	assert.Equal(t, uint32(nbdEPERM), simpleReply.NbdError)
+
+	tc.sendRequest(nbdCmdWriteZeroes, 3, 0, testPageSize)
+	simpleReply = tc.readSimpleReply()
+	assert.Equal(t, uint32(nbdEPERM), simpleReply.NbdError)
+
+	tc.sendRequest(nbdCmdRead, 4, 0, 1)
+	simpleReply = tc.readSimpleReply()
+	assert.Equal(t, uint32(0), simpleReply.NbdError)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(tc.conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), buf[0])
+
+	tc.sendRequest(nbdCmdDisc, 5, 0, 0)
+}
+
+func TestBlockStatus(t *testing.T) {
+	backend := newMemBackend()
+	_, err := backend.WriteAt([]byte{42}, 2*testPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := connect(t, backend)
+
+	tc.sendOption(nbdOptSetMetaContext, metaContextOptionData("", "base:allocation"))
+	reply, _ := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrInvalid), reply.NbdOptionReplyType,
+		"structured replies are required")
+
+	tc.sendOption(nbdOptStructuredReply, nil)
+	tc.readOptionReply()
+
+	tc.sendOption(nbdOptListMetaContext, metaContextOptionData(""))
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	assert.Equal(t, "base:allocation", string(payload[4:]))
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	assert.Equal(t, "sia:cache", string(payload[4:]))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptListMetaContext, metaContextOptionData("", "sia:"))
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	assert.Equal(t, "sia:cache", string(payload[4:]))
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptSetMetaContext, metaContextOptionData("", "base:allocation", "other:thing"))
+	reply, payload = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	contextID := binary.BigEndian.Uint32(payload[0:4])
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdBlockStatus, 5, 0, testExportSize)
+	chunk, payload := tc.readChunk()
+	assert.Equal(t, uint16(nbdReplyTypeBlockStatus), chunk.NbdStructuredReplyType)
+	assert.Equal(t, uint16(nbdReplyFlagDone), chunk.NbdStructuredReplyFlags)
+	assert.Equal(t, contextID, binary.BigEndian.Uint32(payload[0:4]))
+
+	var descriptors [3]nbdBlockDescriptor
+	assert.Equal(t, 4+3*8, len(payload))
+	for i := range descriptors {
+		descriptors[i].NbdExtentLength = binary.BigEndian.Uint32(payload[4+8*i:])
+		descriptors[i].NbdStatusFlags = binary.BigEndian.Uint32(payload[8+8*i:])
+	}
+	assert.Equal(t, nbdBlockDescriptor{2 * testPageSize, nbdStateHole | nbdStateZero}, descriptors[0])
+	assert.Equal(t, nbdBlockDescriptor{testPageSize, 0}, descriptors[1])
+	assert.Equal(t, nbdBlockDescriptor{testPageSize, nbdStateHole | nbdStateZero}, descriptors[2])
+
+	tc.sendRequest(nbdCmdDisc, 6, 0, 0)
+}
+
+func TestExtendedHeaders(t *testing.T) {
+	backend := newMemBackend()
+	tc := connect(t, backend)
+
+	tc.sendOption(nbdOptExtendedHeaders, nil)
+	reply, _ := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	// structured replies are implied
+	tc.sendOption(nbdOptSetMetaContext, metaContextOptionData("", "base:allocation"))
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	contextID := binary.BigEndian.Uint32(payload[0:4])
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tc.goToTransmission()
+
+	tc.sendExtendedRequest(nbdCmdWrite, 1, testPageSize, 1)
+	_, err := tc.conn.Write([]byte{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, payload := tc.readExtendedChunk()
+	assert.Equal(t, uint16(nbdReplyTypeNone), chunk.NbdExtendedReplyType)
+	assert.Equal(t, uint16(nbdReplyFlagDone), chunk.NbdExtendedReplyFlags)
+	assert.Equal(t, uint64(1), chunk.NbdHandle)
+	assert.Equal(t, uint64(testPageSize), chunk.NbdOffset)
+	assert.Empty(t, payload)
+
+	tc.sendExtendedRequest(nbdCmdBlockStatus, 2, 0, testExportSize)
+	chunk, payload = tc.readExtendedChunk()
+	assert.Equal(t, uint16(nbdReplyTypeBlockStatusExt), chunk.NbdExtendedReplyType)
+	assert.Equal(t, uint16(nbdReplyFlagDone), chunk.NbdExtendedReplyFlags)
+	assert.Equal(t, contextID, binary.BigEndian.Uint32(payload[0:4]))
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(payload[4:8]))
+	assert.Equal(t, 8+3*16, len(payload))
+	assert.Equal(t, uint64(testPageSize), binary.BigEndian.Uint64(payload[8:16]))
+	assert.Equal(t, uint64(nbdStateHole|nbdStateZero), binary.BigEndian.Uint64(payload[16:24]))
+	assert.Equal(t, uint64(testPageSize), binary.BigEndian.Uint64(payload[24:32]))
+	assert.Equal(t, uint64(0), binary.BigEndian.Uint64(payload[32:40]))
+	assert.Equal(t, uint64(2*testPageSize), binary.BigEndian.Uint64(payload[40:48]))
+
+	tc.sendExtendedRequest(nbdCmdRead, 3, testPageSize, 1)
+	chunk, payload = tc.readExtendedChunk()
+	assert.Equal(t, uint16(nbdReplyTypeOffsetData), chunk.NbdExtendedReplyType)
+	assert.Equal(t, uint64(testPageSize), binary.BigEndian.Uint64(payload[0:8]))
+	assert.Equal(t, []byte{42}, payload[8:])
+
+	// lengths beyond 32 bits are accepted, but still checked
+	tc.sendExtendedRequest(nbdCmdTrim, 4, 0, 1<<32)
+	chunk, payload = tc.readExtendedChunk()
+	assert.Equal(t, uint16(nbdReplyTypeError), chunk.NbdExtendedReplyType)
+	assert.Equal(t, uint16(nbdReplyFlagDone), chunk.NbdExtendedReplyFlags)
+	assert.Equal(t, uint32(nbdEINVAL), binary.BigEndian.Uint32(payload[0:4]))
+
+	tc.sendExtendedRequest(nbdCmdDisc, 5, 0, 0)
+}
+
+type trimRecordingBackend struct {
+	*memBackend
+	trimmed []int
+}
+
+func (tb *trimRecordingBackend) Trim(offset int64, length int) error {
+	tb.trimmed = append(tb.trimmed, length)
+	return nil
+}
+
+func TestExtendedTrim(t *testing.T) {
+	backend := &trimRecordingBackend{memBackend: newMemBackend()}
+	export := Export{
+		Name:    testExportName,
+		Size:    1 << 40,
+		Backend: backend,
+	}
+	tc := connectToExports(t, nil, []Export{export})
+
+	tc.sendOption(nbdOptExtendedHeaders, nil)
+	tc.readOptionReply()
+	tc.goToTransmission()
+
+	tc.sendExtendedRequest(nbdCmdTrim, 1, 0, 1<<40)
+	chunk, _ := tc.readExtendedChunk()
+	assert.Equal(t, uint16(nbdReplyTypeNone), chunk.NbdExtendedReplyType)
+	assert.Equal(t, []int{1 << 40}, backend.trimmed)
+
+	tc.sendExtendedRequest(nbdCmdDisc, 2, 0, 0)
+}
+
+func TestCacheStatus(t *testing.T) {
+	backend := newMemBackend()
+	_, err := backend.WriteAt([]byte{42}, testPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := connect(t, backend)
+	tc.sendOption(nbdOptStructuredReply, nil)
+	tc.readOptionReply()
+
+	tc.sendOption(nbdOptSetMetaContext, metaContextOptionData("", "sia:cache"))
+	reply, payload := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepMetaContext), reply.NbdOptionReplyType)
+	assert.Equal(t, "sia:cache", string(payload[4:]))
+	tc.readOptionReply()
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdBlockStatus, 9, testPageSize, testPageSize)
+	chunk, payload := tc.readChunk()
+	assert.Equal(t, uint16(nbdReplyTypeBlockStatus), chunk.NbdStructuredReplyType)
+	assert.Equal(t, 4+8, len(payload))
+	assert.Equal(t, uint32(testPageSize), binary.BigEndian.Uint32(payload[4:]))
+	assert.Equal(t, uint32(CacheStateCachedChanged), binary.BigEndian.Uint32(payload[8:]))
+
+	tc.sendRequest(nbdCmdDisc, 10, 0, 0)
+}
+
+// blockingBackend holds up reads of the first page until it is released.
+type blockingBackend struct {
+	*memBackend
+	release chan struct{}
+}
+
+func (bb *blockingBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < testPageSize {
+		<-bb.release
+	}
+	return bb.memBackend.ReadAt(buf, offset)
+}
+
+func TestPipelining(t *testing.T) {
+	backend := &blockingBackend{
+		memBackend: newMemBackend(),
+		release:    make(chan struct{}),
+	}
+
+	tc := connect(t, backend)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdRead, 1, 0, 8)
+	tc.sendRequest(nbdCmdRead, 2, testPageSize, 8)
+
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint64(2), reply.NbdHandle, "expected slow request to be overtaken")
+	_, err := io.ReadFull(tc.conn, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(backend.release)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply.NbdHandle)
+	_, err = io.ReadFull(tc.conn, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc.sendRequest(nbdCmdDisc, 3, 0, 0)
+}
+
+func TestBufferBudget(t *testing.T) {
+	backend := &blockingBackend{
+		memBackend: newMemBackend(),
+		release:    make(chan struct{}),
+	}
+	export := Export{Name: testExportName, Size: testExportSize, Backend: backend}
+	server := NewServer(nil, nil, []Export{export})
+	server.buffers = newBufferBudget(8)
+
+	tc := connectToServer(t, server)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdRead, 1, 0, 8)
+	tc.sendRequest(nbdCmdRead, 2, testPageSize, 8)
+
+	// the second read waits for the buffer of the first one
+	err := tc.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tc.conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "expected second read to wait")
+	err = tc.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(backend.release)
+	for handle := uint64(1); handle <= 2; handle++ {
+		reply := tc.readSimpleReply()
+		assert.Equal(t, handle, reply.NbdHandle)
+		_, err = io.ReadFull(tc.conn, make([]byte, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc.sendRequest(nbdCmdDisc, 3, 0, 0)
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &blockingBackend{
+		memBackend: newMemBackend(),
+		release:    make(chan struct{}),
+	}
+	export := Export{Name: testExportName, Size: testExportSize, Backend: backend}
+	server := NewServer(ln, nil, []Export{export})
+
+	tc := connectToServer(t, server)
+	tc.goToTransmission()
+	tc.sendRequest(nbdCmdRead, 1, 0, 8)
+	for inFlight := 0; inFlight == 0; {
+		time.Sleep(time.Millisecond)
+		server.mutex.Lock()
+		inFlight = server.inFlight
+		server.mutex.Unlock()
+	}
+
+	shutdownDone := make(chan error)
+	go func() {
+		shutdownDone <- server.Shutdown(time.Minute)
+	}()
+	for !server.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new requests are refused while the first one is still in flight
+	tc.sendRequest(nbdCmdRead, 2, testPageSize, 8)
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint64(2), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdESHUTDOWN), reply.NbdError)
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown did not wait for request in flight")
+	default:
+	}
+
+	close(backend.release)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply.NbdHandle)
+	assert.Equal(t, uint32(0), reply.NbdError)
+	_, err = io.ReadFull(tc.conn, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc.sendRequest(nbdCmdDisc, 3, 0, 0)
+	assert.Nil(t, <-shutdownDone)
+	assert.NotNil(t, server.Shutdown(time.Minute))
+}
+
+// flushingBackend counts the writes that have not been covered by a flush
+// yet. It can be used from several connections at once.
+type flushingBackend struct {
+	*memBackend
+	mutex     *sync.Mutex
+	unflushed int
+}
+
+func (fb *flushingBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	return fb.memBackend.ReadAt(buf, offset)
+}
+
+func (fb *flushingBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	fb.unflushed += 1
+	return fb.memBackend.WriteAt(buf, offset)
+}
+
+func (fb *flushingBackend) Flush() error {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	fb.unflushed = 0
+	return nil
+}
+
+func TestMultipleClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &flushingBackend{
+		memBackend: newMemBackend(),
+		mutex:      &sync.Mutex{},
+	}
+	export := Export{Name: testExportName, Size: testExportSize, Backend: backend}
+	server := NewServer(ln, nil, []Export{export})
+
+	serveDone := make(chan error)
+	go func() {
+		serveDone <- server.Serve()
+	}()
+
+	first := dial(t, ln)
+	first.goToTransmission()
+
+	// the second client is served while the first one is still connected
+	second := dial(t, ln)
+	second.goToTransmission()
+
+	second.sendRequest(nbdCmdWrite, 1, 100, 3)
+	_, err = second.conn.Write([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := second.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+
+	first.sendRequest(nbdCmdRead, 2, 100, 3)
+	reply = first.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	data := make([]byte, 3)
+	_, err = io.ReadFull(first.conn, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{1, 2, 3}, data)
+
+	// a flush covers writes that have completed on any connection
+	backend.mutex.Lock()
+	assert.Equal(t, 1, backend.unflushed)
+	backend.mutex.Unlock()
+	first.sendRequest(nbdCmdFlush, 3, 0, 0)
+	reply = first.readSimpleReply()
+	assert.Equal(t, uint32(0), reply.NbdError)
+	backend.mutex.Lock()
+	assert.Equal(t, 0, backend.unflushed)
+	backend.mutex.Unlock()
+
+	first.sendRequest(nbdCmdDisc, 4, 0, 0)
+	second.sendRequest(nbdCmdDisc, 5, 0, 0)
+	assert.Nil(t, server.Shutdown(time.Minute))
+	assert.Nil(t, <-serveDone)
+}
+
+type failingBackend struct {
+	*memBackend
+	err error
+}
+
+func (fb *failingBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	return 0, fb.err
+}
+
+func (fb *failingBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	return 0, fb.err
+}
+
+func TestErrorReplies(t *testing.T) {
+	backend := &failingBackend{
+		memBackend: newMemBackend(),
+		err:        &os.PathError{Op: "write", Path: "page0", Err: syscall.ENOSPC},
+	}
+	tc := connect(t, backend)
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdWrite, 1, 0, 1)
+	_, err := tc.conn.Write([]byte{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdENOSPC), reply.NbdError)
+
+	// no data follows a failed read
+	backend.err = errors.New("download failed")
+	tc.sendRequest(nbdCmdRead, 2, 0, 1)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(2), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdEIO), reply.NbdError)
+
+	tc.sendRequest(42, 3, 0, 0)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(3), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdEINVAL), reply.NbdError)
+
+	// the connection is still usable
+	tc.sendRequest(nbdCmdFlush, 4, 0, 0)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(4), reply.NbdHandle)
+	assert.Equal(t, uint32(0), reply.NbdError)
+
+	tc.sendRequest(nbdCmdDisc, 5, 0, 0)
+}
+
+func TestBoundsChecking(t *testing.T) {
+	tc := connect(t, newMemBackend())
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdRead, 1, testExportSize-1, 2)
+	reply := tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdEINVAL), reply.NbdError)
+
+	tc.sendRequest(nbdCmdWrite, 2, testExportSize, 1)
+	_, err := tc.conn.Write([]byte{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(2), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdENOSPC), reply.NbdError)
+
+	// an offset that would overflow
+	tc.sendRequest(nbdCmdTrim, 3, math.MaxUint64, 2)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(3), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdEINVAL), reply.NbdError)
+
+	tc.sendRequest(nbdCmdRead, 4, 0, maxRequestLength+1)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(4), reply.NbdHandle)
+	assert.Equal(t, uint32(nbdEINVAL), reply.NbdError)
+
+	// requests right up to the end are fine
+	tc.sendRequest(nbdCmdRead, 5, testExportSize-1, 1)
+	reply = tc.readSimpleReply()
+	assert.Equal(t, uint64(5), reply.NbdHandle)
+	assert.Equal(t, uint32(0), reply.NbdError)
+	_, err = io.ReadFull(tc.conn, make([]byte, 1))
+	assert.Nil(t, err)
+
+	tc.sendRequest(nbdCmdDisc, 6, 0, 0)
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, uint32(nbdEIO), errorCode(errors.New("download failed")))
+	assert.Equal(t, uint32(nbdENOSPC), errorCode(
+		&os.PathError{Op: "write", Path: "page0", Err: syscall.ENOSPC}))
+	assert.Equal(t, uint32(nbdESHUTDOWN), errorCode(
+		fmt.Errorf("backend is no longer available: %w", syscall.ESHUTDOWN)))
+	assert.Equal(t, uint32(nbdEPERM), errorCode(syscall.EROFS))
+	assert.Equal(t, uint32(nbdEIO), errorCode(syscall.EBADF))
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sia-nbdserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCertificate(t)},
+	}
+
+	tc := connectWithTLS(t, tlsConfig, newMemBackend())
+
+	tc.sendOption(nbdOptGo, []byte{0, 0, 0, 0, 0, 0})
+	reply, _ := tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrTLSReqd), reply.NbdOptionReplyType)
+
+	tc.sendOption(nbdOptStartTLS, nil)
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepAck), reply.NbdOptionReplyType)
+
+	tlsConn := tls.Client(tc.conn, &tls.Config{InsecureSkipVerify: true})
+	err := tlsConn.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.conn = tlsConn
+
+	tc.sendOption(nbdOptStartTLS, nil)
+	reply, _ = tc.readOptionReply()
+	assert.Equal(t, uint32(nbdRepErrInvalid), reply.NbdOptionReplyType)
+
+	tc.goToTransmission()
+
+	tc.sendRequest(nbdCmdRead, 1, 0, 4)
+	reply2 := tc.readSimpleReply()
+	assert.Equal(t, uint64(1), reply2.NbdHandle)
+	_, err = io.ReadFull(tc.conn, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc.sendRequest(nbdCmdDisc, 2, 0, 0)
+}
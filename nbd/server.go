@@ -0,0 +1,299 @@
+package nbd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// Server serves a set of exports to clients. Once Shutdown has been
+	// called, the server drains: requests that are already being processed
+	// are completed, but everything that follows is refused.
+	Server struct {
+		ln        net.Listener
+		tlsConfig *tls.Config
+		exports   []Export
+
+		mutex    *sync.Mutex
+		draining bool
+		inFlight int
+		drained  chan struct{}
+		conns    map[int]net.Conn
+		wg       *sync.WaitGroup
+
+		buffers *bufferBudget
+	}
+
+	// bufferBudget limits the memory taken up by the buffers of requests
+	// that are being processed, across all clients.
+	bufferBudget struct {
+		cond      *sync.Cond
+		available uint64
+	}
+
+	// deadliner is implemented by the listeners returned from Listen.
+	deadliner interface {
+		SetDeadline(t time.Time) error
+	}
+)
+
+// NewServer returns a server for the given exports. Serve needs to be called
+// to actually accept clients.
+func NewServer(ln net.Listener, tlsConfig *tls.Config, exports []Export) *Server {
+	return &Server{
+		ln:        ln,
+		tlsConfig: tlsConfig,
+		exports:   exports,
+		mutex:     &sync.Mutex{},
+		draining:  false,
+		inFlight:  0,
+		drained:   make(chan struct{}),
+		conns:     map[int]net.Conn{},
+		wg:        &sync.WaitGroup{},
+		buffers:   newBufferBudget(maxBufferedLength),
+	}
+}
+
+// Serve accepts clients until the server is shut down or one of the
+// backends is no longer available. It returns once all clients are gone.
+func (s *Server) Serve() error {
+	log.Printf("Server listens at %s - connect with:\n", s.ln.Addr())
+	log.Printf("  # modprobe nbd\n")
+	for i, export := range s.exports {
+		switch addr := s.ln.Addr().(type) {
+		case *net.TCPAddr:
+			log.Printf("  # nbd-client -N %s %s %d /dev/nbd%d\n",
+				export.Name, addr.IP, addr.Port, i)
+		default:
+			log.Printf("  # nbd-client -N %s -u %s /dev/nbd%d\n", export.Name, addr, i)
+		}
+	}
+	if s.tlsConfig != nil {
+		log.Printf("Clients are required to use TLS\n")
+	}
+
+	for clientID := 1; s.available(); {
+		// Wake up from Accept() periodically to
+		// check if we need to shutdown the server.
+		s.ln.(deadliner).SetDeadline(time.Now().Add(interruptInterval))
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+
+			// Shutdown closes the listener to stop accepting clients.
+			if s.isDraining() {
+				break
+			}
+			return err
+		}
+
+		// Registering the client and checking for a shutdown need
+		// to happen together, so that Shutdown does not miss it.
+		s.mutex.Lock()
+		if s.draining {
+			s.mutex.Unlock()
+			conn.Close()
+			break
+		}
+		s.conns[clientID] = conn
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		log.Printf("Client %d connected", clientID)
+		go func(clientID int, conn net.Conn) {
+			defer s.wg.Done()
+
+			err := s.handle(conn)
+			if err != nil {
+				log.Printf("Client %d disconnected with error: %s", clientID, err)
+			} else {
+				log.Printf("Client %d disconnected", clientID)
+			}
+
+			s.mutex.Lock()
+			delete(s.conns, clientID)
+			s.mutex.Unlock()
+
+			err = conn.Close()
+			if err != nil {
+				log.Printf("Error while closing connection of client %d: %s", clientID, err)
+			}
+		}(clientID, conn)
+
+		clientID += 1
+	}
+
+	if !s.isDraining() {
+		err := s.ln.Close()
+		if err != nil {
+			return err
+		}
+
+		s.disconnectAll()
+	}
+
+	s.wg.Wait()
+	return nil
+}
+
+// Shutdown stops accepting new clients and waits for the requests that are
+// currently being processed. Later requests are refused with ESHUTDOWN, so
+// that clients can disconnect cleanly. Clients that are still around once
+// the timeout has passed are disconnected.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	deadline := time.After(timeout)
+
+	s.mutex.Lock()
+	if s.draining {
+		s.mutex.Unlock()
+		return errors.New("server is already shutting down")
+	}
+
+	s.draining = true
+	if s.inFlight == 0 {
+		close(s.drained)
+	}
+	s.mutex.Unlock()
+
+	log.Printf("Draining server\n")
+	err := s.ln.Close()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-s.drained:
+	case <-deadline:
+		log.Printf("Timeout while waiting for requests to complete\n")
+		s.disconnectAll()
+		return nil
+	}
+
+	clientsGone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(clientsGone)
+	}()
+
+	select {
+	case <-clientsGone:
+	case <-deadline:
+		log.Printf("Timeout while waiting for clients to disconnect\n")
+		s.disconnectAll()
+	}
+
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) error {
+	c := connection{
+		server:               s,
+		conn:                 conn,
+		writer:               bufio.NewWriter(conn),
+		writeMutex:           &sync.Mutex{},
+		tlsConfig:            s.tlsConfig,
+		tlsActive:            false,
+		exports:              s.exports,
+		exportSize:           0,
+		readOnly:             false,
+		backend:              nil,
+		structuredReplies:    false,
+		extendedHeaders:      false,
+		selectedMetaContexts: []uint32{},
+	}
+
+	transmit, err := c.negotiate()
+	if err != nil {
+		return err
+	}
+
+	if !transmit {
+		return nil
+	}
+
+	return c.transmit()
+}
+
+// beginRequest registers a request that is about to be processed. It returns
+// false if the server is draining and the request should be refused.
+func (s *Server) beginRequest() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.inFlight += 1
+	return true
+}
+
+func (s *Server) endRequest() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inFlight -= 1
+	if s.draining && s.inFlight == 0 {
+		close(s.drained)
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.draining
+}
+
+func (s *Server) disconnectAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// available reports whether all exports can still be served. They are shut
+// down together, so the server stops as soon as one of them is gone.
+func (s *Server) available() bool {
+	for _, export := range s.exports {
+		if !export.Backend.Available() {
+			return false
+		}
+	}
+	return true
+}
+
+func newBufferBudget(length uint64) *bufferBudget {
+	return &bufferBudget{
+		cond:      sync.NewCond(&sync.Mutex{}),
+		available: length,
+	}
+}
+
+// reserve waits until the given number of bytes can be buffered.
+func (bb *bufferBudget) reserve(length uint64) {
+	bb.cond.L.Lock()
+	defer bb.cond.L.Unlock()
+
+	for bb.available < length {
+		bb.cond.Wait()
+	}
+	bb.available -= length
+}
+
+func (bb *bufferBudget) release(length uint64) {
+	bb.cond.L.Lock()
+	defer bb.cond.L.Unlock()
+
+	bb.available += length
+	bb.cond.Broadcast()
+}
@@ -0,0 +1,486 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"syscall"
+)
+
+type (
+	pendingRequest struct {
+		request  nbdExtendedRequest
+		payload  []byte
+		buffered uint64
+	}
+
+	// failure remembers the first error that occurred while processing
+	// requests, which ends the connection.
+	failure struct {
+		mutex *sync.Mutex
+		err   error
+	}
+)
+
+// transmit handles the transmission phase. Requests are read by the calling
+// goroutine and handed to a pool of workers, so that a slow request (e.g. a
+// page that needs to be downloaded first) does not hold up the ones behind
+// it. Replies are matched to requests by their handle and can therefore be
+// sent in any order.
+func (c *connection) transmit() error {
+	requests := make(chan pendingRequest)
+	firstFailure := failure{
+		mutex: &sync.Mutex{},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for pendingRequest := range requests {
+				err := c.process(pendingRequest)
+				c.server.buffers.release(pendingRequest.buffered)
+				if err != nil {
+					firstFailure.record(err)
+
+					// unblock the receiving goroutine
+					c.conn.Close()
+				}
+			}
+		}()
+	}
+
+	err := c.receive(requests)
+	close(requests)
+	wg.Wait()
+
+	firstFailure.record(err)
+	return firstFailure.err
+}
+
+// receive reads requests until the client disconnects. Any payload is read
+// here as well, so that the next request can follow right away. The buffer
+// that a request needs is reserved up front and released by the worker once
+// the request has been processed. Reading the next request waits while too
+// much is buffered, so that clients can not take up unlimited memory.
+func (c *connection) receive(requests chan<- pendingRequest) error {
+	for {
+		request, err := c.readRequest()
+		if err != nil {
+			return err
+		}
+
+		buffered := bufferedLength(request)
+		c.server.buffers.reserve(buffered)
+
+		var payload []byte
+		if request.NbdCommandType == nbdCmdWrite {
+			if request.NbdLength > maxRequestLength {
+				// The payload is skipped to stay in sync with
+				// the client, an error is sent by process().
+				_, err = io.CopyN(ioutil.Discard, c.conn, int64(request.NbdLength))
+			} else {
+				payload = make([]byte, request.NbdLength)
+				_, err = io.ReadFull(c.conn, payload)
+			}
+			if err != nil {
+				c.server.buffers.release(buffered)
+				return err
+			}
+		}
+
+		if request.NbdCommandType == nbdCmdDisc {
+			return nil
+		}
+
+		requests <- pendingRequest{
+			request:  request,
+			payload:  payload,
+			buffered: buffered,
+		}
+	}
+}
+
+// bufferedLength is the size of the buffer that a request needs, either for
+// its payload or for the data that is read.
+func bufferedLength(request nbdExtendedRequest) uint64 {
+	switch request.NbdCommandType {
+	case nbdCmdRead, nbdCmdWrite:
+		if request.NbdLength <= maxRequestLength {
+			return request.NbdLength
+		}
+	}
+	return 0
+}
+
+// readRequest reads a request header. Without extended headers, the request
+// is converted to the extended form.
+func (c *connection) readRequest() (nbdExtendedRequest, error) {
+	if c.extendedHeaders {
+		var request nbdExtendedRequest
+		err := binary.Read(c.conn, binary.BigEndian, &request)
+		if err != nil {
+			return nbdExtendedRequest{}, err
+		}
+
+		if request.NbdRequestMagic != nbdExtendedRequestMagic {
+			return nbdExtendedRequest{}, errors.New("did not receive extended request magic")
+		}
+
+		return request, nil
+	}
+
+	var request nbdRequest
+	err := binary.Read(c.conn, binary.BigEndian, &request)
+	if err != nil {
+		return nbdExtendedRequest{}, err
+	}
+
+	if request.NbdRequestMagic != nbdRequestMagic {
+		return nbdExtendedRequest{}, errors.New("did not receive request magic")
+	}
+
+	return nbdExtendedRequest{
+		NbdRequestMagic: nbdExtendedRequestMagic,
+		NbdCommandFlags: request.NbdCommandFlags,
+		NbdCommandType:  request.NbdCommandType,
+		NbdHandle:       request.NbdHandle,
+		NbdOffset:       request.NbdOffset,
+		NbdLength:       uint64(request.NbdLength),
+	}, nil
+}
+
+func (c *connection) process(pendingRequest pendingRequest) error {
+	request := pendingRequest.request
+
+	if !c.server.beginRequest() {
+		return c.sendSimpleReply(request, nbdESHUTDOWN)
+	}
+	defer c.server.endRequest()
+
+	nbdError := c.validate(request)
+	if nbdError != 0 {
+		return c.sendSimpleReply(request, nbdError)
+	}
+
+	switch request.NbdCommandType {
+	case nbdCmdRead:
+		buf := make([]byte, request.NbdLength)
+
+		if c.structuredReplies {
+			return c.sendStructuredRead(request, buf)
+		}
+
+		_, err := c.backend.ReadAt(buf, int64(request.NbdOffset))
+		if err != nil {
+			// No data follows a simple reply that reports an error.
+			return c.sendErrorReply(request, err)
+		}
+
+		reply := nbdSimpleReply{
+			NbdSimpleReplyMagic: nbdSimpleReplyMagic,
+			NbdError:            0,
+			NbdHandle:           request.NbdHandle,
+		}
+		return c.send(reply, buf)
+	case nbdCmdWrite:
+		_, err := c.backend.WriteAt(pendingRequest.payload, int64(request.NbdOffset))
+		if err == nil {
+			err = c.forceUnitAccess(request)
+		}
+		if err != nil {
+			return c.sendErrorReply(request, err)
+		}
+
+		return c.sendSimpleReply(request, 0)
+	case nbdCmdFlush:
+		err := c.backend.Flush()
+		if err != nil {
+			return c.sendErrorReply(request, err)
+		}
+
+		return c.sendSimpleReply(request, 0)
+	case nbdCmdTrim:
+		err := c.backend.Trim(int64(request.NbdOffset), int(request.NbdLength))
+		if err == nil {
+			err = c.forceUnitAccess(request)
+		}
+		if err != nil {
+			return c.sendErrorReply(request, err)
+		}
+
+		return c.sendSimpleReply(request, 0)
+	case nbdCmdCache:
+		// The reply does not wait for the data to arrive
+		// in the cache, as this can take quite a while.
+		err := c.backend.Prefetch(int64(request.NbdOffset), int(request.NbdLength))
+		if err != nil {
+			return c.sendErrorReply(request, err)
+		}
+
+		return c.sendSimpleReply(request, 0)
+	case nbdCmdWriteZeroes:
+		noHole := request.NbdCommandFlags&nbdCmdFlagNoHole != 0
+		err := c.backend.WriteZeroes(int64(request.NbdOffset), int(request.NbdLength), noHole)
+		if err == nil {
+			err = c.forceUnitAccess(request)
+		}
+		if err != nil {
+			return c.sendErrorReply(request, err)
+		}
+
+		return c.sendSimpleReply(request, 0)
+	case nbdCmdBlockStatus:
+		if len(c.selectedMetaContexts) == 0 || request.NbdLength == 0 {
+			return c.sendSimpleReply(request, nbdEINVAL)
+		}
+
+		return c.sendBlockStatus(request)
+	default:
+		return c.sendSimpleReply(request, nbdEINVAL)
+	}
+}
+
+// forceUnitAccess makes sure that the changes of a request have reached
+// persistent storage before the reply is sent, if the client asked for it.
+func (c *connection) forceUnitAccess(request nbdExtendedRequest) error {
+	if request.NbdCommandFlags&nbdCmdFlagFUA == 0 {
+		return nil
+	}
+
+	return c.backend.Sync(int64(request.NbdOffset), int(request.NbdLength))
+}
+
+// validate checks a request against the size of the export and the maximum
+// request length. Changes to a read-only export are reported as EPERM, writes
+// past the end as ENOSPC and all other invalid requests as EINVAL.
+func (c *connection) validate(request nbdExtendedRequest) uint32 {
+	switch request.NbdCommandType {
+	case nbdCmdRead, nbdCmdWrite:
+		if request.NbdLength > maxRequestLength {
+			return nbdEINVAL
+		}
+	case nbdCmdTrim, nbdCmdCache, nbdCmdWriteZeroes, nbdCmdBlockStatus:
+		// only the range needs to be checked
+	default:
+		return 0
+	}
+
+	isChange := request.NbdCommandType == nbdCmdWrite ||
+		request.NbdCommandType == nbdCmdTrim || request.NbdCommandType == nbdCmdWriteZeroes
+	if c.readOnly && isChange {
+		return nbdEPERM
+	}
+
+	if request.NbdOffset > c.exportSize ||
+		request.NbdLength > c.exportSize-request.NbdOffset {
+		if request.NbdCommandType == nbdCmdWrite {
+			return nbdENOSPC
+		}
+		return nbdEINVAL
+	}
+
+	return 0
+}
+
+// sendErrorReply reports a failed request to the client, which can then
+// decide for itself how to deal with it. The connection stays open.
+func (c *connection) sendErrorReply(request nbdExtendedRequest, cause error) error {
+	log.Printf("Request of type %d at offset %d failed: %s",
+		request.NbdCommandType, request.NbdOffset, cause)
+	return c.sendSimpleReply(request, errorCode(cause))
+}
+
+// sendSimpleReply sends a reply without any data. There are no simple replies
+// with extended headers, so an equivalent structured reply is sent instead.
+func (c *connection) sendSimpleReply(request nbdExtendedRequest, nbdError uint32) error {
+	if c.extendedHeaders {
+		if nbdError == 0 {
+			return c.sendChunk(request, nbdReplyFlagDone, nbdReplyTypeNone, 0)
+		}
+
+		errorHeader := nbdReplyErrorHeader{
+			NbdError:         nbdError,
+			NbdMessageLength: 0,
+		}
+		return c.sendChunk(request, nbdReplyFlagDone, nbdReplyTypeError,
+			6 /* size of nbdReplyErrorHeader struct */, errorHeader)
+	}
+
+	reply := nbdSimpleReply{
+		NbdSimpleReplyMagic: nbdSimpleReplyMagic,
+		NbdError:            nbdError,
+		NbdHandle:           request.NbdHandle,
+	}
+	return c.send(reply)
+}
+
+// sendChunk sends one chunk of a structured reply, with an extended header
+// if those have been negotiated.
+func (c *connection) sendChunk(request nbdExtendedRequest, flags uint16, replyType uint16,
+	length int, parts ...interface{}) error {
+	var header interface{}
+	if c.extendedHeaders {
+		header = nbdExtendedReplyChunk{
+			NbdExtendedReplyMagic:  nbdExtendedReplyMagic,
+			NbdExtendedReplyFlags:  flags,
+			NbdExtendedReplyType:   replyType,
+			NbdHandle:              request.NbdHandle,
+			NbdOffset:              request.NbdOffset,
+			NbdExtendedReplyLength: uint64(length),
+		}
+	} else {
+		header = nbdStructuredReplyChunk{
+			NbdStructuredReplyMagic:  nbdStructuredMagic,
+			NbdStructuredReplyFlags:  flags,
+			NbdStructuredReplyType:   replyType,
+			NbdHandle:                request.NbdHandle,
+			NbdStructuredReplyLength: uint32(length),
+		}
+	}
+
+	return c.send(append([]interface{}{header}, parts...)...)
+}
+
+// sendBlockStatus answers a block status request with one chunk for each
+// selected meta context.
+func (c *connection) sendBlockStatus(request nbdExtendedRequest) error {
+	extents := c.backend.Extents(int64(request.NbdOffset), int(request.NbdLength))
+	onlyOne := request.NbdCommandFlags&nbdCmdFlagReqOne != 0
+
+	for i, id := range c.selectedMetaContexts {
+		flags := uint16(0)
+		if i == len(c.selectedMetaContexts)-1 {
+			flags = nbdReplyFlagDone
+		}
+
+		descriptors := blockDescriptors(id, extents, onlyOne)
+
+		var err error
+		if c.extendedHeaders {
+			length := 8 /* context ID and descriptor count as uint32 */ + 16*len(descriptors)
+			err = c.sendChunk(request, flags, nbdReplyTypeBlockStatusExt, length,
+				id, uint32(len(descriptors)), descriptors)
+		} else {
+			length := 4 /* context ID as uint32 */ + 8*len(descriptors)
+			err = c.sendChunk(request, flags, nbdReplyTypeBlockStatus, length,
+				id, narrowBlockDescriptors(descriptors))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendStructuredRead answers a read request with a series of chunks. Ranges
+// that have never been written are sent as holes and do not need to be
+// fetched from the backend.
+func (c *connection) sendStructuredRead(request nbdExtendedRequest, buf []byte) error {
+	offset := request.NbdOffset
+	extents := c.backend.Extents(int64(request.NbdOffset), int(request.NbdLength))
+	if len(extents) == 0 {
+		return c.sendChunk(request, nbdReplyFlagDone, nbdReplyTypeNone, 0)
+	}
+
+	for i, extent := range extents {
+		flags := uint16(0)
+		if i == len(extents)-1 {
+			flags = nbdReplyFlagDone
+		}
+
+		if extent.Zero {
+			hole := nbdReplyOffsetHole{
+				NbdOffset:   offset,
+				NbdHoleSize: uint32(extent.Length),
+			}
+			err := c.sendChunk(request, flags, nbdReplyTypeOffsetHole,
+				12 /* size of nbdReplyOffsetHole struct */, hole)
+			if err != nil {
+				return err
+			}
+
+			offset += uint64(extent.Length)
+			continue
+		}
+
+		data := buf[offset-request.NbdOffset : offset-request.NbdOffset+uint64(extent.Length)]
+		_, err := c.backend.ReadAt(data, int64(offset))
+		if err != nil {
+			// The error chunk concludes the reply, as the read
+			// has failed anyway.
+			log.Printf("Request of type %d at offset %d failed: %s",
+				request.NbdCommandType, offset, err)
+			return c.sendErrorChunk(request, offset, errorCode(err), err)
+		}
+
+		length := 8 /* offset as uint64 */ + len(data)
+		err = c.sendChunk(request, flags, nbdReplyTypeOffsetData, length, offset, data)
+		if err != nil {
+			return err
+		}
+
+		offset += uint64(extent.Length)
+	}
+
+	return nil
+}
+
+func (c *connection) sendErrorChunk(request nbdExtendedRequest, offset uint64, nbdError uint32,
+	cause error) error {
+	message := cause.Error()
+	if len(message) > maxErrorMessageLength {
+		message = message[:maxErrorMessageLength]
+	}
+
+	errorHeader := nbdReplyErrorHeader{
+		NbdError:         nbdError,
+		NbdMessageLength: uint16(len(message)),
+	}
+	length := 6 /* size of nbdReplyErrorHeader struct */ + len(message) + 8
+	return c.sendChunk(request, nbdReplyFlagDone, nbdReplyTypeErrorOffset, length,
+		errorHeader, []byte(message), offset)
+}
+
+func (f *failure) record(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// errorCode maps an error of the backend to one of the error values that the
+// protocol allows. Anything that is not recognized becomes EIO.
+func errorCode(err error) uint32 {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return nbdEIO
+	}
+
+	switch errno {
+	case syscall.EPERM, syscall.EACCES, syscall.EROFS:
+		return nbdEPERM
+	case syscall.ENOMEM:
+		return nbdENOMEM
+	case syscall.EINVAL:
+		return nbdEINVAL
+	case syscall.ENOSPC, syscall.EDQUOT, syscall.EFBIG:
+		return nbdENOSPC
+	case syscall.EOVERFLOW:
+		return nbdEOVERFLOW
+	case syscall.ENOTSUP:
+		return nbdENOTSUP
+	case syscall.ESHUTDOWN:
+		return nbdESHUTDOWN
+	default:
+		return nbdEIO
+	}
+}
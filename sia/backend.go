@@ -1,40 +1,70 @@
 package sia
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
-
-	"gitlab.com/NebulousLabs/Sia/modules"
-	"gitlab.com/NebulousLabs/Sia/node/api/client"
-
-	"github.com/javgh/sia-nbdserver/config"
 )
 
 type (
 	backendState int
 
 	Backend struct {
-		state      backendState
-		mutex      *sync.Mutex
-		cache      *cache
-		httpClient *client.Client
+		state             backendState
+		size              int64
+		pageSize          int64
+		dirtyGranularity  int64
+		readOnly          bool
+		strictSync        bool
+		minimumRedundancy float64
+
+		// mutex guards the state and the cache brain. It is only held
+		// for decisions, never during I/O.
+		mutex          *sync.Mutex
+		cache          *cache
+		store          RemoteStore
+		cacheDirectory string
 	}
 
 	BackendSettings struct {
-		Size             uint64
-		HardMaxCached    int
-		SoftMaxCached    int
-		IdleInterval     time.Duration
-		SiaDaemonAddress string
-		SiaPasswordFile  string
+		Size           uint64
+		PageSize       uint64
+		RemoteStore    RemoteStore
+		CacheDirectory string
+		ReadOnly       bool
+		StrictSync     bool
+		HardMaxCached  int
+		SoftMaxCached  int
+		IdleInterval   time.Duration
+
+		// DirtyGranularity is the size of the blocks in which changes to
+		// a page are tracked. The page size needs to be a multiple of it.
+		DirtyGranularity uint64
+
+		// MinimumRedundancy is the redundancy that a page needs to reach
+		// before its upload counts as complete.
+		MinimumRedundancy float64
+	}
+
+	// Extent describes a contiguous range of the device. Zero is set for
+	// ranges that have never been written and therefore read as zeroes.
+	// Cache tells where the data of the range currently lives.
+	Extent struct {
+		Length int
+		Zero   bool
+		Cache  CacheState
 	}
 
+	CacheState int
+
 	pageAccess struct {
 		page      page
 		offset    int64
@@ -43,8 +73,20 @@ type (
 		sliceHigh int
 	}
 
+	// pageIODetails holds what belongs to a page besides its state in the
+	// cache brain. The cache file and its dirty map are guarded by the lock
+	// of the page, the rest by Backend.mutex. The lock of a page is never
+	// taken while holding Backend.mutex.
 	pageIODetails struct {
-		file *os.File
+		mutex      sync.Mutex
+		file       *os.File
+		dirty      *dirtyMap
+		dirtySaved bool
+
+		pending       []action
+		uploadStarted time.Time
+		fileOpen      bool
+		prefetched    chan struct{}
 	}
 
 	cache struct {
@@ -55,15 +97,13 @@ type (
 )
 
 const (
-	siaPathPrefix         = "nbd"
-	pageSize              = 64 * 1024 * 1024
 	waitInterval          = 5 * time.Second
-	defaultDataPieces     = 10
-	defaultParityPieces   = 20
-	minimumRedundancy     = 2.5
 	writeThrottleInterval = 5 * time.Millisecond
 	writeThrottleLeeway   = 5
-	useCachedRenterInfo   = true
+	pinInterval           = 1 * time.Hour
+
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
 )
 
 const (
@@ -72,16 +112,54 @@ const (
 	unavailable
 )
 
+// These correspond to the states of the cache brain.
+const (
+	CacheStateZero CacheState = iota
+	CacheStateNotCached
+	CacheStateCachedUnchanged
+	CacheStateCachedChanged
+	CacheStateCachedUploading
+)
+
+const readOnlyCacheDirectory = "readonly"
+
+var (
+	// errUnavailable wraps ESHUTDOWN, so that clients can tell that the
+	// server is going away.
+	errUnavailable = fmt.Errorf("backend is no longer available: %w", syscall.ESHUTDOWN)
+
+	errReadOnly = fmt.Errorf("backend is read-only: %w", syscall.EPERM)
+)
+
 func NewBackend(settings BackendSettings) (*Backend, error) {
-	dataDirectory := config.PrependDataDirectory("")
-	log.Printf("Storing cache in %s\n", dataDirectory)
-	err := os.MkdirAll(dataDirectory, 0700)
+	// Another instance might be using the volume at the same time, so a
+	// read-only backend keeps its cache away from the regular one.
+	if settings.ReadOnly {
+		settings.CacheDirectory = filepath.Join(settings.CacheDirectory, readOnlyCacheDirectory)
+	}
+
+	log.Printf("Storing cache in %s\n", settings.CacheDirectory)
+	err := os.MkdirAll(settings.CacheDirectory, 0700)
 	if err != nil {
 		return nil, err
 	}
 
-	pageCount := settings.Size / pageSize
-	if settings.Size%pageSize > 0 {
+	if settings.PageSize == 0 {
+		return nil, errors.New("page size needs to be positive")
+	}
+
+	if settings.DirtyGranularity == 0 || settings.PageSize%settings.DirtyGranularity > 0 {
+		return nil, fmt.Errorf("page size %d is not a multiple of the dirty granularity %d",
+			settings.PageSize, settings.DirtyGranularity)
+	}
+
+	err = checkMetadata(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	pageCount := settings.Size / settings.PageSize
+	if settings.Size%settings.PageSize > 0 {
 		pageCount += 1
 	}
 
@@ -97,29 +175,51 @@ func NewBackend(settings BackendSettings) (*Backend, error) {
 		pages:     make([]pageIODetails, pageCount),
 	}
 
-	siaPassword, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	uploadedPages, err := getUploadedPages(settings.RemoteStore, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	httpClient := client.Client{
-		Address:  settings.SiaDaemonAddress,
-		Password: siaPassword,
+	for _, page := range uploadedPages {
+		cache.brain.pages[page].state = notCached
 	}
 
-	uploadedPages, err := getUploadedPages(&httpClient, false)
-	if err != nil {
-		return nil, err
+	// Prefetches and downloads that were interrupted might have left
+	// partial files.
+	for i := 0; i < int(pageCount); i++ {
+		err = os.Remove(asPrefetchPath(settings.CacheDirectory, page(i)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
 	}
 
-	for _, page := range uploadedPages {
-		cache.brain.pages[page].state = notCached
+	err = removeLeftovers(settings.CacheDirectory, "page*"+downloadSuffix)
+	if err != nil {
+		return nil, err
 	}
 
-	cachedPages := getCachedPages(int(pageCount))
+	cachedPages := getCachedPages(settings.CacheDirectory, int(pageCount))
 	actions := []action{}
+	dirtyMaps := map[page]*dirtyMap{}
 	for _, page := range cachedPages {
+		if settings.ReadOnly {
+			// Nothing has been changed in read-only mode, so these
+			// are just copies of data on Sia that might be stale.
+			log.Printf("Removing leftover cache for page %d\n", page)
+			err = os.Remove(asCachePath(settings.CacheDirectory, page))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		log.Printf("Cache for page %d found - assuming it contains unsynced data\n", page)
+		dirtyMaps[page], err = loadDirtyMap(asDirtyPath(settings.CacheDirectory, page),
+			int64(settings.PageSize), int64(settings.DirtyGranularity))
+		if err != nil {
+			return nil, err
+		}
+
 		actions = append(actions, action{
 			actionType: openFile,
 			page:       page,
@@ -129,17 +229,52 @@ func NewBackend(settings BackendSettings) (*Backend, error) {
 	}
 
 	backend := Backend{
-		state:      available,
-		mutex:      &sync.Mutex{},
-		cache:      &cache,
-		httpClient: &httpClient,
+		state:             available,
+		size:              int64(settings.Size),
+		pageSize:          int64(settings.PageSize),
+		dirtyGranularity:  int64(settings.DirtyGranularity),
+		readOnly:          settings.ReadOnly,
+		strictSync:        settings.StrictSync,
+		minimumRedundancy: settings.MinimumRedundancy,
+		mutex:             &sync.Mutex{},
+		cache:             &cache,
+		store:             settings.RemoteStore,
+		cacheDirectory:    settings.CacheDirectory,
 	}
 
-	_, err = backend.handleActions(actions)
+	err = backend.handleActions(actions)
 	if err != nil {
 		return nil, err
 	}
 
+	for page, dirty := range dirtyMaps {
+		backend.cache.pages[page].dirty = dirty
+		backend.cache.pages[page].dirtySaved = !dirty.all
+	}
+
+	// Dirty maps stay valid as long as their cache file is around. Maps
+	// that could not be used would turn valid again once the dirty
+	// granularity is changed back, even though they are outdated by then.
+	removed := false
+	for i := 0; i < int(pageCount); i++ {
+		if backend.cache.pages[i].dirtySaved {
+			continue
+		}
+
+		err = os.Remove(asDirtyPath(settings.CacheDirectory, page(i)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		removed = removed || err == nil
+	}
+
+	if removed {
+		err = syncDirectory(settings.CacheDirectory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	go func() {
 		for !backend.unavailable() {
 			time.Sleep(waitInterval)
@@ -153,75 +288,115 @@ func NewBackend(settings BackendSettings) (*Backend, error) {
 	return &backend, nil
 }
 
-func (b *Backend) handleActions(actions []action) (bool, error) {
+// handleActions carries out the decisions of the cache brain. All actions
+// concern a page that the caller has locked, so nothing else needs to be
+// locked while talking to the remote store.
+func (b *Backend) handleActions(actions []action) error {
 	for _, action := range actions {
 		switch action.actionType {
 		case zeroCache:
 			log.Printf("Initializing cache for page %d with zeroes\n", action.page)
 
-			buf := make([]byte, pageSize)
+			buf := make([]byte, b.pageLength(action.page))
 			_, err := b.cache.pages[action.page].file.Write(buf)
 			if err != nil {
-				return false, err
+				// leave no partial page behind, see abortAccess
+				b.cache.pages[action.page].file.Close()
+				b.setFile(action.page, nil)
+				b.cache.pages[action.page].dirty = nil
+				os.Remove(asCachePath(b.cacheDirectory, action.page))
+				return err
 			}
+
+			b.cache.pages[action.page].dirty.markAll()
 		case deleteCache:
 			log.Printf("Deleting cache for page %d\n", action.page)
 
-			cachePath := asCachePath(action.page)
+			cachePath := asCachePath(b.cacheDirectory, action.page)
 			err := os.Remove(cachePath)
 			if err != nil {
-				return false, err
+				return err
 			}
-		case download:
-			log.Printf("Downloading page %d\n", action.page)
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
-			if err != nil {
-				return false, err
+			// The map goes with the cache file. A leftover is
+			// removed on startup, so the directory needs no sync.
+			err = os.Remove(asDirtyPath(b.cacheDirectory, action.page))
+			if err != nil && !os.IsNotExist(err) {
+				return err
 			}
+			b.cache.pages[action.page].dirtySaved = false
+		case download:
+			log.Printf("Downloading page %d\n", action.page)
 
-			cachePath := asCachePath(action.page)
-			_, err = b.httpClient.RenterDownloadFullGet(siaPath, cachePath, false)
+			cachePath := asCachePath(b.cacheDirectory, action.page)
+			err := b.store.GetPage(int(action.page), cachePath)
 			if err != nil {
-				return false, err
+				return err
 			}
 		case startUpload:
-			log.Printf("Uploading page %d\n", action.page)
+			err := b.upload(action.page)
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
-			if err != nil {
-				return false, err
+			b.mutex.Lock()
+			if err == nil {
+				b.cache.pages[action.page].uploadStarted = time.Now()
+			} else {
+				b.cache.brain.abortUpload(action.page)
 			}
+			b.mutex.Unlock()
 
-			cachePath := asCachePath(action.page)
-			err = b.httpClient.RenterUploadForcePost(
-				cachePath, siaPath, defaultDataPieces, defaultParityPieces, true)
 			if err != nil {
-				return false, err
+				return err
 			}
 		case postponeUpload:
 			log.Printf("Postponing upload for page %d\n", action.page)
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
+			// The remote copy is gone, so the whole page needs to be
+			// uploaded later on.
+			b.cache.pages[action.page].dirty.markAll()
+			err := b.removeDirtyMap(action.page)
+			if err != nil {
+				return err
+			}
+
+			err = b.store.DeletePage(int(action.page))
 			if err != nil {
-				return false, err
+				return err
 			}
+		case deleteRemote:
+			log.Printf("Deleting page %d from remote store\n", action.page)
 
-			err = b.httpClient.RenterFileDeletePost(siaPath)
+			err := b.store.DeletePage(int(action.page))
+			if err != nil {
+				return err
+			}
+		case usePrefetch:
+			err := os.Rename(asPrefetchPath(b.cacheDirectory, action.page),
+				asCachePath(b.cacheDirectory, action.page))
 			if err != nil {
-				return false, err
+				return err
+			}
+		case discardPrefetch:
+			err := os.Remove(asPrefetchPath(b.cacheDirectory, action.page))
+			if err != nil && !os.IsNotExist(err) {
+				return err
 			}
+		case completeUpload:
+			log.Printf("Upload complete for page %d\n", action.page)
+
+			b.cache.pages[action.page].dirty.clear()
 		case openFile:
 			if b.cache.pages[action.page].file != nil {
 				panic("file handling is inconsistent")
 			}
 
-			file, err := os.OpenFile(asCachePath(action.page), os.O_RDWR|os.O_CREATE, 0600)
+			cachePath := asCachePath(b.cacheDirectory, action.page)
+			file, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE, 0600)
 			if err != nil {
-				return false, err
+				return err
 			}
 
-			b.cache.pages[action.page].file = file
+			b.setFile(action.page, file)
+			b.cache.pages[action.page].dirty = newDirtyMap(b.pageSize, b.dirtyGranularity, false)
 		case closeFile:
 			if b.cache.pages[action.page].file == nil {
 				panic("file handling is inconsistent")
@@ -229,34 +404,234 @@ func (b *Backend) handleActions(actions []action) (bool, error) {
 
 			err := b.cache.pages[action.page].file.Close()
 			if err != nil {
-				return false, err
+				return err
 			}
 
-			b.cache.pages[action.page].file = nil
-		case waitAndRetry:
-			return true, nil
+			b.setFile(action.page, nil)
+			b.cache.pages[action.page].dirty = nil
 		default:
 			panic("unknown action")
 		}
 	}
 
-	return false, nil
+	return nil
 }
 
-func (b *Backend) maintenance() error {
+// queueActions hands decisions of the cache brain over to the pages they
+// concern, to be carried out by whoever locks the page next. It is called
+// with b.mutex held and reports the pages that now have actions queued, as
+// well as whether the cache brain asked to wait and retry.
+func (b *Backend) queueActions(actions []action) ([]page, bool) {
+	pages := []page{}
+
+	for _, action := range actions {
+		if action.actionType == waitAndRetry {
+			return pages, true
+		}
+
+		details := &b.cache.pages[action.page]
+
+		// A prefetch needs no lock and is started right away, as it
+		// would otherwise be lost if an earlier action fails. Accesses
+		// to the page wait until it has been dealt with.
+		if action.actionType == prefetch {
+			log.Printf("Prefetching page %d\n", action.page)
+
+			details.prefetched = make(chan struct{})
+			go b.prefetch(action.page)
+			continue
+		}
+
+		if len(details.pending) == 0 {
+			pages = append(pages, action.page)
+		}
+
+		// A listing of the remote store only says something about
+		// an upload once the upload has actually been started.
+		if action.actionType == startUpload || action.actionType == postponeUpload {
+			details.uploadStarted = time.Time{}
+		}
+
+		details.pending = append(details.pending, action)
+	}
+
+	return pages, false
+}
+
+// runPending carries out the actions that are queued for a page. The caller
+// needs to hold the lock of the page.
+func (b *Backend) runPending(page page) error {
+	b.mutex.Lock()
+	actions := b.cache.pages[page].pending
+	b.cache.pages[page].pending = nil
+	b.mutex.Unlock()
+
+	return b.handleActions(actions)
+}
+
+// runPendingPages carries on after an error, as the actions of the other
+// pages would otherwise wait for the next access. It returns the first error.
+func (b *Backend) runPendingPages(pages []page) error {
+	var firstErr error
+
+	for _, page := range pages {
+		b.lockPage(page)
+		err := b.runPending(page)
+		b.unlockPage(page)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// decide asks the cache brain about a page that the caller has locked and
+// carries out the resulting actions. While the cache brain asks to wait, the
+// page is unlocked in between attempts. A prefetch of the page cuts the wait
+// short once it is done.
+func (b *Backend) decide(page page, decision func() []action) error {
+	for {
+		b.mutex.Lock()
+		// a shutdown would otherwise undo its own decisions, like
+		// restarting an upload
+		if b.state != available {
+			b.mutex.Unlock()
+			return errUnavailable
+		}
+
+		previous := b.cache.brain.pages[page].state
+		_, retry := b.queueActions(decision())
+		prefetched := b.cache.pages[page].prefetched
+		b.mutex.Unlock()
+
+		err := b.runPending(page)
+		if err != nil {
+			b.abortAccess(page, previous)
+			return err
+		}
+
+		if !retry {
+			return nil
+		}
+
+		b.unlockPage(page)
+		select {
+		case <-prefetched:
+		case <-time.After(waitInterval):
+		}
+		b.lockPage(page)
+	}
+}
+
+// setFile also records whether the cache file is open in a way that can be
+// read without the lock of the page, see unsyncedPages.
+func (b *Backend) setFile(page page, file *os.File) {
+	b.mutex.Lock()
+	b.cache.pages[page].fileOpen = file != nil
+	b.mutex.Unlock()
+
+	b.cache.pages[page].file = file
+}
+
+func (b *Backend) lockPage(page page) {
+	b.cache.pages[page].mutex.Lock()
+}
+
+func (b *Backend) unlockPage(page page) {
+	b.cache.pages[page].mutex.Unlock()
+}
+
+// upload sends only the changed parts of the page, if the remote store
+// supports that and still holds a copy of the page.
+func (b *Backend) upload(page page) error {
+	cachePath := asCachePath(b.cacheDirectory, page)
+	dirty := b.cache.pages[page].dirty
+
+	partialStore, ok := b.store.(PartialRemoteStore)
+	if !ok || dirty == nil || dirty.all {
+		log.Printf("Uploading page %d\n", page)
+		return b.store.PutPage(int(page), cachePath)
+	}
+
+	ranges := dirty.ranges(int64(b.pageLength(page)))
+	log.Printf("Uploading %d changed ranges of page %d\n", len(ranges), page)
+	return partialStore.PutPageRanges(int(page), cachePath, ranges)
+}
+
+// prefetch downloads a page without holding any lock, so that other requests
+// are not held up. The cache brain then decides whether the download is still
+// of use.
+func (b *Backend) prefetch(page page) {
+	err := b.store.GetPage(int(page), asPrefetchPath(b.cacheDirectory, page))
+	if err != nil {
+		log.Printf("Error while prefetching page %d: %s", page, err)
+	}
+
+	b.lockPage(page)
+	defer b.unlockPage(page)
+
+	b.mutex.Lock()
+	downloaded := err == nil && b.state == available
+	b.queueActions(b.cache.brain.completePrefetch(page, downloaded, time.Now()))
+	b.mutex.Unlock()
+
+	err = b.runPending(page)
+	if err != nil {
+		b.abortAccess(page, notCached)
+		log.Printf("Error while prefetching page %d: %s", page, err)
+	}
+
+	b.mutex.Lock()
+	close(b.cache.pages[page].prefetched)
+	b.cache.pages[page].prefetched = nil
+	b.mutex.Unlock()
+}
+
+// abortAccess rolls back the cache brain if a page could not be brought into
+// the cache or returned to the zero state. The caller needs to hold the lock
+// of the page.
+func (b *Backend) abortAccess(page page, previous state) {
+	cached := b.cache.pages[page].file != nil
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	if b.cache.brain.abortTrim(page, previous, cached) {
+		log.Printf("Unable to trim page %d\n", page)
+
+		// the remote copy might be gone already
+		if cached {
+			b.cache.pages[page].dirty.markAll()
+		}
+		b.cache.pages[page].pending = nil
+		return
+	}
+
+	if !cached && b.cache.brain.abortAccess(page, previous) {
+		log.Printf("Unable to cache page %d\n", page)
+
+		// anything else decided in the meantime assumed a cached page
+		b.cache.pages[page].pending = nil
+	}
+}
+
+func (b *Backend) maintenance() error {
+	b.mutex.Lock()
 	if b.state == unavailable {
+		b.mutex.Unlock()
 		return nil
 	}
 
-	actions := b.cache.brain.maintenance(time.Now())
-	_, err := b.handleActions(actions)
+	pages, _ := b.queueActions(b.cache.brain.maintenance(time.Now()))
+	b.mutex.Unlock()
+
+	err := b.runPendingPages(pages)
 	if err != nil {
 		return err
 	}
 
+	b.mutex.Lock()
 	anyUploading := false
 	for i := 0; i < b.cache.brain.pageCount; i++ {
 		if b.cache.brain.pages[i].state == cachedUploading {
@@ -264,24 +639,34 @@ func (b *Backend) maintenance() error {
 			break
 		}
 	}
+	b.mutex.Unlock()
 
 	if !anyUploading {
 		return nil
 	}
 
-	uploadedPages, err := getUploadedPages(b.httpClient, true)
+	listed := time.Now()
+	uploadedPages, err := getUploadedPages(b.store, b.minimumRedundancy)
 	if err != nil {
 		return err
 	}
 
+	b.mutex.Lock()
+	actions := []action{}
 	for _, page := range uploadedPages {
-		if b.cache.brain.pages[page].state == cachedUploading {
-			log.Printf("Upload complete for page %d\n", page)
-			b.cache.brain.pages[page].state = cachedUnchanged
+		// The listing might still show an earlier copy of the page if
+		// the upload was started after it.
+		uploadStarted := b.cache.pages[page].uploadStarted
+		if uploadStarted.IsZero() || !uploadStarted.Before(listed) {
+			continue
 		}
+
+		actions = append(actions, b.cache.brain.completeUpload(page)...)
 	}
+	pages, _ = b.queueActions(actions)
+	b.mutex.Unlock()
 
-	return nil
+	return b.runPendingPages(pages)
 }
 
 func (b *Backend) unavailable() bool {
@@ -299,33 +684,18 @@ func (b *Backend) Available() bool {
 }
 
 func (b *Backend) ReadAt(buf []byte, offset int64) (int, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if !b.Available() {
+		return 0, errUnavailable
+	}
 
-	if b.state != available {
-		return 0, errors.New("backend is no longer available")
+	err := b.checkRange(offset, len(buf), false)
+	if err != nil {
+		return 0, err
 	}
 
 	n := 0
-	for _, pageAccess := range determinePages(offset, len(buf)) {
-		for {
-			actions := b.cache.brain.prepareAccess(pageAccess.page, false, time.Now())
-			retry, err := b.handleActions(actions)
-			if err != nil {
-				return n, err
-			}
-
-			if !retry {
-				break
-			} else {
-				b.mutex.Unlock()
-				time.Sleep(waitInterval)
-				b.mutex.Lock()
-			}
-		}
-
-		partialN, err := b.cache.pages[pageAccess.page].file.ReadAt(
-			buf[pageAccess.sliceLow:pageAccess.sliceHigh], pageAccess.offset)
+	for _, pageAccess := range determinePages(offset, len(buf), b.pageSize) {
+		partialN, err := b.readPage(pageAccess, buf[pageAccess.sliceLow:pageAccess.sliceHigh])
 		n += partialN
 		if err != nil {
 			return n, err
@@ -334,79 +704,459 @@ func (b *Backend) ReadAt(buf []byte, offset int64) (int, error) {
 	return n, nil
 }
 
-func (b *Backend) WriteAt(buf []byte, offset int64) (int, error) {
+func (b *Backend) readPage(pageAccess pageAccess, buf []byte) (int, error) {
+	b.lockPage(pageAccess.page)
+	defer b.unlockPage(pageAccess.page)
+
+	// Pages that were never written or have been trimmed are read as
+	// zeroes. Reading would otherwise materialize them in the cache, which
+	// then need to be uploaded.
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	zeroPage := b.cache.brain.pages[pageAccess.page].state == zero
+	b.mutex.Unlock()
 
-	if b.state != available {
-		return 0, errors.New("backend is no longer available")
+	if zeroPage {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return len(buf), nil
 	}
 
+	err := b.decide(pageAccess.page, func() []action {
+		return b.cache.brain.prepareAccess(pageAccess.page, false, time.Now())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return b.cache.pages[pageAccess.page].file.ReadAt(buf, pageAccess.offset)
+}
+
+func (b *Backend) WriteAt(buf []byte, offset int64) (int, error) {
+	if !b.Available() {
+		return 0, errUnavailable
+	}
+
+	if b.readOnly {
+		return 0, errReadOnly
+	}
+
+	err := b.checkRange(offset, len(buf), true)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mutex.Lock()
 	writeThrottleLevel := b.cache.brain.cacheCount - (b.cache.brain.softMaxCached + writeThrottleLeeway)
+	b.mutex.Unlock()
+
 	if writeThrottleLevel >= 0 {
 		writeThrottleMultiplier := int64(math.Pow(2, float64(writeThrottleLevel)))
 		writeThrottleDuration := time.Duration(writeThrottleMultiplier * int64(writeThrottleInterval))
-
-		b.mutex.Unlock()
 		time.Sleep(writeThrottleDuration)
-		b.mutex.Lock()
 	}
 
 	n := 0
-	for _, pageAccess := range determinePages(offset, len(buf)) {
-		for {
-			actions := b.cache.brain.prepareAccess(pageAccess.page, true, time.Now())
-			retry, err := b.handleActions(actions)
-			if err != nil {
-				return n, err
-			}
+	for _, pageAccess := range determinePages(offset, len(buf), b.pageSize) {
+		partialN, err := b.writePage(pageAccess, buf[pageAccess.sliceLow:pageAccess.sliceHigh])
+		n += partialN
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
 
-			if !retry {
-				break
-			} else {
-				b.mutex.Unlock()
-				time.Sleep(waitInterval)
-				b.mutex.Lock()
+func (b *Backend) writePage(pageAccess pageAccess, data []byte) (int, error) {
+	b.lockPage(pageAccess.page)
+	defer b.unlockPage(pageAccess.page)
+
+	// Writing zeroes to a page that was never written changes nothing.
+	b.mutex.Lock()
+	zeroPage := b.cache.brain.pages[pageAccess.page].state == zero
+	b.mutex.Unlock()
+
+	if zeroPage && isZero(data) {
+		return len(data), nil
+	}
+
+	// The page is first accessed like for a read, so that rewriting it
+	// with the same contents does not lead to another upload.
+	err := b.decide(pageAccess.page, func() []action {
+		return b.cache.brain.prepareAccess(pageAccess.page, false, time.Now())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	changes, err := b.findChanges(pageAccess.page, data, pageAccess.offset)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(changes) == 0 {
+		return len(data), nil
+	}
+
+	err = b.decide(pageAccess.page, func() []action {
+		return b.cache.brain.prepareAccess(pageAccess.page, true, time.Now())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only marked now, as the decision might have completed an upload
+	// and cleared the dirty map.
+	for _, change := range changes {
+		err = b.markDirty(pageAccess.page, change.Offset, change.Length)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return b.cache.pages[pageAccess.page].file.WriteAt(data, pageAccess.offset)
+}
+
+// findChanges compares the data with what is cached at the given offset of
+// the page. It returns the blocks that differ.
+func (b *Backend) findChanges(page page, data []byte, offset int64) ([]PageRange, error) {
+	changes := []PageRange{}
+
+	cached := make([]byte, len(data))
+	_, err := b.cache.pages[page].file.ReadAt(cached, offset)
+	if err != nil && err != io.EOF {
+		return changes, err
+	}
+
+	for low := int64(0); low < int64(len(data)); {
+		blockEnd := ((offset+low)/b.dirtyGranularity + 1) * b.dirtyGranularity
+		high := min64(blockEnd-offset, int64(len(data)))
+
+		if !bytes.Equal(cached[low:high], data[low:high]) {
+			changes = append(changes, PageRange{Offset: offset + low, Length: high - low})
+		}
+		low = high
+	}
+
+	return changes, nil
+}
+
+func (b *Backend) Trim(offset int64, length int) error {
+	if !b.Available() {
+		return errUnavailable
+	}
+
+	if b.readOnly {
+		return errReadOnly
+	}
+
+	err := b.checkRange(offset, length, false)
+	if err != nil {
+		return err
+	}
+
+	for _, pageAccess := range determinePages(offset, length, b.pageSize) {
+		err := b.trimPage(pageAccess)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backend) trimPage(pageAccess pageAccess) error {
+	b.lockPage(pageAccess.page)
+	defer b.unlockPage(pageAccess.page)
+
+	wholePage := pageAccess.length == b.pageLength(pageAccess.page)
+	err := b.decide(pageAccess.page, func() []action {
+		return b.cache.brain.prepareTrim(pageAccess.page, wholePage, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	if wholePage || b.cache.pages[pageAccess.page].file == nil {
+		return nil
+	}
+
+	err = b.markDirty(pageAccess.page, pageAccess.offset, int64(pageAccess.length))
+	if err != nil {
+		return err
+	}
+
+	return punchHole(b.cache.pages[pageAccess.page].file,
+		pageAccess.offset, pageAccess.length)
+}
+
+func (b *Backend) WriteZeroes(offset int64, length int, noHole bool) error {
+	if !b.Available() {
+		return errUnavailable
+	}
+
+	if b.readOnly {
+		return errReadOnly
+	}
+
+	err := b.checkRange(offset, length, true)
+	if err != nil {
+		return err
+	}
+
+	for _, pageAccess := range determinePages(offset, length, b.pageSize) {
+		err := b.writeZeroesPage(pageAccess, noHole)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backend) writeZeroesPage(pageAccess pageAccess, noHole bool) error {
+	b.lockPage(pageAccess.page)
+	defer b.unlockPage(pageAccess.page)
+
+	wholePage := pageAccess.length == b.pageLength(pageAccess.page)
+
+	var zeroRange bool
+	err := b.decide(pageAccess.page, func() []action {
+		var actions []action
+		actions, zeroRange = b.cache.brain.prepareWriteZeroes(
+			pageAccess.page, wholePage, noHole, time.Now())
+		return actions
+	})
+	if err != nil {
+		return err
+	}
+
+	if !zeroRange {
+		return nil
+	}
+
+	err = b.markDirty(pageAccess.page, pageAccess.offset, int64(pageAccess.length))
+	if err != nil {
+		return err
+	}
+
+	file := b.cache.pages[pageAccess.page].file
+	if noHole {
+		_, err := file.WriteAt(make([]byte, pageAccess.length), pageAccess.offset)
+		return err
+	}
+	return punchHole(file, pageAccess.offset, pageAccess.length)
+}
+
+// Extents reports the state of the pages in the given range. Neighbouring
+// pages in the same state are combined into one extent. Anything beyond the
+// end of the device is left out.
+func (b *Backend) Extents(offset int64, length int) []Extent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	extents := []Extent{}
+	if offset < 0 || offset >= b.size {
+		return extents
+	}
+	length = int(min64(int64(length), b.size-offset))
+
+	for _, pageAccess := range determinePages(offset, length, b.pageSize) {
+		state := b.cache.brain.pages[pageAccess.page].state
+		cacheState := asCacheState(state)
+
+		if len(extents) > 0 && extents[len(extents)-1].Cache == cacheState {
+			extents[len(extents)-1].Length += pageAccess.length
+			continue
+		}
+
+		extents = append(extents, Extent{
+			Length: pageAccess.length,
+			Zero:   state == zero,
+			Cache:  cacheState,
+		})
+	}
+	return extents
+}
+
+func (b *Backend) PageSize() int {
+	return int(b.pageSize)
+}
+
+func (b *Backend) Flush() error {
+	if !b.Available() {
+		return errUnavailable
+	}
+
+	for _, page := range b.unsyncedPages(0, b.cache.pageCount) {
+		err := b.syncPage(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	// On startup, the state of the cache brain is reconstructed from the
+	// files found in the cache directory. Syncing the directory makes sure
+	// that newly created cache files are still around after a crash.
+	return syncDirectory(b.cacheDirectory)
+}
+
+// Sync makes sure that the given range has reached the disk. In strict mode,
+// it also waits until the affected pages have been uploaded to Sia with
+// sufficient redundancy.
+func (b *Backend) Sync(offset int64, length int) error {
+	if !b.Available() {
+		return errUnavailable
+	}
+
+	err := b.checkRange(offset, length, false)
+	if err != nil {
+		return err
+	}
+
+	pageAccesses := determinePages(offset, length, b.pageSize)
+	if len(pageAccesses) > 0 {
+		first := int(pageAccesses[0].page)
+		last := int(pageAccesses[len(pageAccesses)-1].page)
+		for _, page := range b.unsyncedPages(first, last+1) {
+			err = b.syncPage(page)
+			if err != nil {
+				return err
 			}
 		}
+	}
 
-		partialN, err := b.cache.pages[pageAccess.page].file.WriteAt(
-			buf[pageAccess.sliceLow:pageAccess.sliceHigh], pageAccess.offset)
-		n += partialN
+	err = syncDirectory(b.cacheDirectory)
+	if err != nil {
+		return err
+	}
+
+	if !b.strictSync {
+		return nil
+	}
+
+	for _, pageAccess := range pageAccesses {
+		b.lockPage(pageAccess.page)
+		err = b.decide(pageAccess.page, func() []action {
+			return b.cache.brain.prepareSync(pageAccess.page)
+		})
+		b.unlockPage(pageAccess.page)
 		if err != nil {
-			return n, err
+			return err
 		}
 	}
-	return n, nil
+
+	return nil
 }
 
-func (b *Backend) Shutdown(thorough bool) error {
+// unsyncedPages returns the pages in the given range whose cache files might
+// hold changes that have not reached the disk yet. Pages that are still being
+// downloaded have no open file and hold no changes yet, so that a flush never
+// needs to wait for a download.
+func (b *Backend) unsyncedPages(low int, high int) []page {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	pages := []page{}
+	for i := low; i < high; i++ {
+		state := b.cache.brain.pages[i].state
+		if b.cache.pages[i].fileOpen && (state == cachedChanged || state == cachedUploading) {
+			pages = append(pages, page(i))
+		}
+	}
+
+	return pages
+}
+
+// syncPage also saves the dirty map of the page, as it matches the cache file
+// on disk at this point.
+func (b *Backend) syncPage(page page) error {
+	b.lockPage(page)
+	defer b.unlockPage(page)
+
+	file := b.cache.pages[page].file
+	if file == nil {
+		return nil
+	}
+
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return b.saveDirtyMap(page)
+}
+
+// Prefetch starts downloading the pages of the given range in the background
+// and protects them from eviction for a while.
+func (b *Backend) Prefetch(offset int64, length int) error {
+	if !b.Available() {
+		return errUnavailable
+	}
+
+	err := b.checkRange(offset, length, false)
+	if err != nil {
+		return err
+	}
+
+	for _, pageAccess := range determinePages(offset, length, b.pageSize) {
+		b.lockPage(pageAccess.page)
+		err = b.decide(pageAccess.page, func() []action {
+			return b.cache.brain.prepareCache(pageAccess.page, time.Now())
+		})
+		b.unlockPage(pageAccess.page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backend) Shutdown(thorough bool) error {
+	b.mutex.Lock()
 	b.state = shuttingDown
+	b.mutex.Unlock()
+
 	for {
-		actions := b.cache.brain.prepareShutdown(thorough)
-		retry, err := b.handleActions(actions)
+		b.mutex.Lock()
+		pages, retry := b.queueActions(b.cache.brain.prepareShutdown(thorough))
+		b.mutex.Unlock()
+
+		err := b.runPendingPages(pages)
 		if err != nil {
-			return err
+			if !thorough {
+				return err
+			}
+
+			// failed uploads are started again on the next round
+			log.Printf("Error while shutting down: %s\n", err)
+			retry = true
 		}
 
 		if !retry {
 			break
-		} else {
-			b.mutex.Unlock()
-			time.Sleep(waitInterval)
-			b.mutex.Lock()
 		}
+		time.Sleep(waitInterval)
 	}
 
-	cachedPages := getCachedPages(int(b.cache.brain.pageCount))
+	cachedPages := getCachedPages(b.cacheDirectory, int(b.cache.brain.pageCount))
 	for _, page := range cachedPages {
 		log.Printf("Fast shutdown leaves unsynced changes in cache for page %d\n", page)
+
+		err := b.syncPage(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cachedPages) > 0 {
+		err := syncDirectory(b.cacheDirectory)
+		if err != nil {
+			return err
+		}
 	}
 
+	b.mutex.Lock()
 	b.state = unavailable
+	b.mutex.Unlock()
 	return nil
 }
 
@@ -421,39 +1171,108 @@ func (b *Backend) Wait() {
 	}
 }
 
-func getUploadedPages(httpClient *client.Client, checkRedundancy bool) ([]page, error) {
-	pages := []page{}
+// saveDirtyMap stores the dirty map next to the cache file, once the file
+// itself has reached the disk. If the whole page is dirty, no map is needed.
+// The caller needs to hold the lock of the page.
+func (b *Backend) saveDirtyMap(page page) error {
+	dirty := b.cache.pages[page].dirty
+	if dirty.all {
+		return b.removeDirtyMap(page)
+	}
 
-	renterFiles, err := httpClient.RenterFilesGet(useCachedRenterInfo)
+	err := dirty.save(asDirtyPath(b.cacheDirectory, page))
 	if err != nil {
-		return pages, err
+		return err
 	}
 
-	for _, fileInfo := range renterFiles.Files {
-		if !isRelevantSiaPath(fileInfo.SiaPath.String()) {
-			continue
-		}
+	b.cache.pages[page].dirtySaved = true
+	return nil
+}
+
+// removeDirtyMap makes sure that a saved map is gone for good, before changes
+// that it does not cover can reach the disk. The caller needs to hold the
+// lock of the page.
+func (b *Backend) removeDirtyMap(page page) error {
+	if !b.cache.pages[page].dirtySaved {
+		return nil
+	}
+
+	err := os.Remove(asDirtyPath(b.cacheDirectory, page))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-		page, err := getPageFromSiaPath(fileInfo.SiaPath.String())
+	err = syncDirectory(b.cacheDirectory)
+	if err != nil {
+		return err
+	}
+
+	b.cache.pages[page].dirtySaved = false
+	return nil
+}
+
+// markDirty records changes to a page that the caller has locked. A saved map
+// that does not cover them is removed first.
+func (b *Backend) markDirty(page page, offset int64, length int64) error {
+	details := &b.cache.pages[page]
+	if details.dirtySaved && !details.dirty.covers(offset, length) {
+		err := b.removeDirtyMap(page)
 		if err != nil {
-			return pages, err
+			return err
 		}
+	}
+
+	details.dirty.mark(offset, length)
+	return nil
+}
+
+// checkRange makes sure that a request stays within the device. Writes past
+// the end are reported as ENOSPC, everything else as EINVAL.
+func (b *Backend) checkRange(offset int64, length int, write bool) error {
+	if offset >= 0 && length >= 0 && offset <= b.size && int64(length) <= b.size-offset {
+		return nil
+	}
 
-		uploadComplete := fileInfo.Available && fileInfo.Recoverable &&
-			(!checkRedundancy || fileInfo.Redundancy >= minimumRedundancy)
+	errno := syscall.EINVAL
+	if write {
+		errno = syscall.ENOSPC
+	}
+	return fmt.Errorf("access of %d bytes at offset %d is beyond size %d: %w",
+		length, offset, b.size, errno)
+}
+
+// pageLength is the number of bytes of a page that lie within the device. It
+// is only less than the page size for the last page, if the size of the
+// device is not a multiple of the page size.
+func (b *Backend) pageLength(page page) int {
+	return int(min64(b.pageSize, b.size-int64(page)*b.pageSize))
+}
+
+// getUploadedPages returns the pages that can be downloaded from the remote
+// store and have reached the given redundancy.
+func getUploadedPages(store RemoteStore, minimumRedundancy float64) ([]page, error) {
+	pages := []page{}
+
+	remotePages, err := store.ListPages()
+	if err != nil {
+		return pages, err
+	}
+
+	for _, remotePage := range remotePages {
+		uploadComplete := remotePage.Recoverable && remotePage.Redundancy >= minimumRedundancy
 		if uploadComplete {
-			pages = append(pages, page)
+			pages = append(pages, page(remotePage.Page))
 		}
 	}
 
 	return pages, nil
 }
 
-func getCachedPages(pageCount int) []page {
+func getCachedPages(cacheDirectory string, pageCount int) []page {
 	pages := []page{}
 
 	for i := 0; i < pageCount; i++ {
-		cachePath := asCachePath(page(i))
+		cachePath := asCachePath(cacheDirectory, page(i))
 
 		if fileCanBeStated(cachePath) {
 			pages = append(pages, page(i))
@@ -468,31 +1287,74 @@ func fileCanBeStated(name string) bool {
 	return err == nil
 }
 
-func asSiaPath(page page) string {
-	return fmt.Sprintf("%s/page%d", siaPathPrefix, page)
+func punchHole(file *os.File, offset int64, length int) error {
+	err := syscall.Fallocate(int(file.Fd()),
+		fallocFlKeepSize|fallocFlPunchHole, offset, int64(length))
+	if err != syscall.EOPNOTSUPP {
+		return err
+	}
+
+	// fall back to writing zeroes if the filesystem can not punch holes
+	_, err = file.WriteAt(make([]byte, length), offset)
+	return err
 }
 
-func asCachePath(page page) string {
-	return config.PrependDataDirectory(fmt.Sprintf("page%d", page))
+func syncDirectory(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
 }
 
-func isRelevantSiaPath(siaPath string) bool {
-	return strings.HasPrefix(siaPath, fmt.Sprintf("%s/page", siaPathPrefix))
+func asCachePath(cacheDirectory string, page page) string {
+	return filepath.Join(cacheDirectory, fmt.Sprintf("page%d", page))
 }
 
-func getPageFromSiaPath(siaPath string) (page, error) {
-	var page page
+func asPrefetchPath(cacheDirectory string, page page) string {
+	return asCachePath(cacheDirectory, page) + ".prefetch"
+}
 
-	format := fmt.Sprintf("%s/page%%d", siaPathPrefix)
-	_, err := fmt.Sscanf(siaPath, format, &page)
+func asDirtyPath(cacheDirectory string, page page) string {
+	return asCachePath(cacheDirectory, page) + ".dirty"
+}
+
+func removeLeftovers(cacheDirectory string, pattern string) error {
+	paths, err := filepath.Glob(filepath.Join(cacheDirectory, pattern))
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return page, nil
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+	return syncDirectory(cacheDirectory)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
 
-func determinePages(offset int64, length int) []pageAccess {
+func determinePages(offset int64, length int, pageSize int64) []pageAccess {
 	pageAccesses := []pageAccess{}
 
 	slicePos := 0
@@ -524,3 +1386,10 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,13 +1,24 @@
 package sia
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+const testPageSize = 64 * 1024 * 1024
+
 func TestDeterminePages(t *testing.T) {
-	pageAccesses := determinePages(3, 5)
+	pageAccesses := determinePages(3, 5, testPageSize)
 	assert.Equal(t, 1, len(pageAccesses))
 	expectedPageAccess := pageAccess{
 		page:      0,
@@ -18,7 +29,7 @@ func TestDeterminePages(t *testing.T) {
 	}
 	assert.Equal(t, expectedPageAccess, pageAccesses[0])
 
-	pageAccesses = determinePages(60000000, 10000000)
+	pageAccesses = determinePages(60000000, 10000000, testPageSize)
 	assert.Equal(t, 2, len(pageAccesses))
 	expectedFirstPageAccess := pageAccess{
 		page:      0,
@@ -37,11 +48,11 @@ func TestDeterminePages(t *testing.T) {
 	}
 	assert.Equal(t, expectedSecondPageAccess, pageAccesses[1])
 
-	pageAccesses = determinePages(2*pageSize-1, pageSize+2)
+	pageAccesses = determinePages(2*testPageSize-1, testPageSize+2, testPageSize)
 	assert.Equal(t, 3, len(pageAccesses))
 	expectedFirstPageAccess = pageAccess{
 		page:      1,
-		offset:    pageSize - 1,
+		offset:    testPageSize - 1,
 		length:    1,
 		sliceLow:  0,
 		sliceHigh: 1,
@@ -50,17 +61,373 @@ func TestDeterminePages(t *testing.T) {
 	expectedSecondPageAccess = pageAccess{
 		page:      2,
 		offset:    0,
-		length:    pageSize,
+		length:    testPageSize,
 		sliceLow:  1,
-		sliceHigh: 1 + pageSize,
+		sliceHigh: 1 + testPageSize,
 	}
 	assert.Equal(t, expectedSecondPageAccess, pageAccesses[1])
 	expectedThirdPageAccess := pageAccess{
 		page:      3,
 		offset:    0,
 		length:    1,
-		sliceLow:  1 + pageSize,
-		sliceHigh: 1 + pageSize + 1,
+		sliceLow:  1 + testPageSize,
+		sliceHigh: 1 + testPageSize + 1,
 	}
 	assert.Equal(t, expectedThirdPageAccess, pageAccesses[2])
+
+	pageAccesses = determinePages(4000, 200, 4096)
+	assert.Equal(t, 2, len(pageAccesses))
+	expectedSecondPageAccess = pageAccess{
+		page:      1,
+		offset:    0,
+		length:    104,
+		sliceLow:  96,
+		sliceHigh: 200,
+	}
+	assert.Equal(t, expectedSecondPageAccess, pageAccesses[1])
+}
+
+type listingStore struct {
+	RemoteStore
+	pages []RemotePage
+}
+
+func (ls *listingStore) ListPages() ([]RemotePage, error) {
+	return ls.pages, nil
+}
+
+func TestGetUploadedPages(t *testing.T) {
+	store := &listingStore{pages: []RemotePage{
+		{Page: 0, Recoverable: true, Redundancy: 3},
+		{Page: 1, Recoverable: true, Redundancy: 1.5},
+		{Page: 2, Recoverable: false, Redundancy: 0},
+	}}
+
+	pages, err := getUploadedPages(store, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []page{0, 1}, pages)
+
+	pages, err = getUploadedPages(store, 2.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []page{0}, pages)
+}
+
+func TestCheckRange(t *testing.T) {
+	b := Backend{size: 2*testPageSize + 100}
+
+	assert.Nil(t, b.checkRange(0, 10, false))
+	assert.Nil(t, b.checkRange(2*testPageSize, 100, true))
+	assert.Nil(t, b.checkRange(2*testPageSize+100, 0, false))
+
+	err := b.checkRange(2*testPageSize, 101, false)
+	assert.True(t, errors.Is(err, syscall.EINVAL))
+
+	err = b.checkRange(2*testPageSize, 101, true)
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	err = b.checkRange(-1, 1, false)
+	assert.True(t, errors.Is(err, syscall.EINVAL))
+}
+
+func TestPageLength(t *testing.T) {
+	b := Backend{pageSize: testPageSize, size: 2*testPageSize + 100}
+	assert.Equal(t, testPageSize, b.pageLength(0))
+	assert.Equal(t, testPageSize, b.pageLength(1))
+	assert.Equal(t, 100, b.pageLength(2))
+
+	b = Backend{pageSize: testPageSize, size: 2 * testPageSize}
+	assert.Equal(t, testPageSize, b.pageLength(1))
+}
+
+// TestReadZeroPage covers pages that were never written or have been
+// trimmed. They are read as zeroes without being brought into the cache.
+func TestReadZeroPage(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		cacheBrain, err := newCacheBrain(2, 2, 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := Backend{
+			state:    available,
+			size:     2 * testPageSize,
+			pageSize: testPageSize,
+			readOnly: readOnly,
+			mutex:    &sync.Mutex{},
+			cache: &cache{
+				brain:     cacheBrain,
+				pageCount: 2,
+				pages:     make([]pageIODetails, 2),
+			},
+		}
+
+		if readOnly {
+			_, err = b.WriteAt([]byte{42}, 0)
+			assert.True(t, errors.Is(err, syscall.EPERM))
+
+			err = b.Trim(0, testPageSize)
+			assert.True(t, errors.Is(err, syscall.EPERM))
+
+			err = b.WriteZeroes(0, testPageSize, false)
+			assert.True(t, errors.Is(err, syscall.EPERM))
+		}
+
+		buf := []byte{1, 2, 3}
+		n, err := b.ReadAt(buf, testPageSize-1)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, []byte{0, 0, 0}, buf)
+		assert.Equal(t, zero, b.cache.brain.pages[0].state)
+		assert.Equal(t, zero, b.cache.brain.pages[1].state)
+		assert.Equal(t, 0, b.cache.brain.cacheCount)
+	}
+}
+
+// newTestStore sets up a local store in a temporary directory, which the
+// caller needs to remove again. The store holds the metadata of a volume with
+// the given page size, as well as the given pages filled with 42.
+func newTestStore(t *testing.T, pageSize int, storedPages ...int) (*LocalStore, string) {
+	dir := tempDir(t)
+
+	store, err := NewLocalStore(LocalStoreSettings{Directory: filepath.Join(dir, "store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadataPath := filepath.Join(dir, metadataFile)
+	err = writeMetadata(metadataPath, metadata{PageSize: int64(pageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutMetadata(metadataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(dir, "source")
+	err = ioutil.WriteFile(source, bytes.Repeat([]byte{42}, pageSize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range storedPages {
+		err = store.PutPage(page, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return store, dir
+}
+
+// newTestBackend starts a backend with its cache in the given directory.
+// Settings that are left out default to a dirty granularity of a whole page,
+// room for a single cached page and an idle interval of a minute.
+func newTestBackend(t *testing.T, dir string, settings BackendSettings) *Backend {
+	settings.CacheDirectory = filepath.Join(dir, "cache")
+	if settings.DirtyGranularity == 0 {
+		settings.DirtyGranularity = settings.PageSize
+	}
+	if settings.HardMaxCached == 0 {
+		settings.HardMaxCached = 2
+		settings.SoftMaxCached = 1
+	}
+	if settings.IdleInterval == 0 {
+		settings.IdleInterval = time.Minute
+	}
+
+	backend, err := NewBackend(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestFlush(t *testing.T) {
+	const pageSize = 4096
+	store, dir := newTestStore(t, pageSize)
+	defer os.RemoveAll(dir)
+
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:        3 * pageSize,
+		PageSize:    pageSize,
+		RemoteStore: store,
+	})
+
+	// page 0 has a file that has been closed again, page 1 an open one
+	// and page 2 none at all
+	_, err := backend.WriteAt([]byte{1}, 0)
+	assert.Nil(t, err)
+	err = backend.Trim(0, pageSize)
+	assert.Nil(t, err)
+	_, err = backend.WriteAt([]byte{2}, pageSize)
+	assert.Nil(t, err)
+
+	err = backend.Flush()
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(asCachePath(backend.cacheDirectory, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(2), data[0])
+
+	backend.mutex.Lock()
+	backend.state = shuttingDown
+	backend.mutex.Unlock()
+	err = backend.Flush()
+	assert.True(t, errors.Is(err, syscall.ESHUTDOWN))
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+	err = backend.Flush()
+	assert.True(t, errors.Is(err, syscall.ESHUTDOWN))
+}
+
+// TestTrimFailure makes sure that a page stays usable if its remote copy can
+// not be deleted.
+func TestTrimFailure(t *testing.T) {
+	const pageSize = 4096
+	store, dir := newTestStore(t, pageSize, 0, 1)
+	defer os.RemoveAll(dir)
+
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:        2 * pageSize,
+		PageSize:    pageSize,
+		RemoteStore: store,
+	})
+
+	_, err := backend.WriteAt([]byte{1}, 0)
+	assert.Nil(t, err)
+
+	store.failureRate = 1
+	err = backend.Trim(0, pageSize)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.Equal(t, cachedChanged, backend.cache.brain.pages[0].state)
+	assert.Equal(t, 1, backend.cache.brain.cacheCount)
+	assert.True(t, backend.cache.pages[0].dirty.all)
+
+	err = backend.WriteZeroes(0, pageSize, false)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.Equal(t, cachedChanged, backend.cache.brain.pages[0].state)
+
+	err = backend.Trim(pageSize, pageSize)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.Equal(t, notCached, backend.cache.brain.pages[1].state)
+
+	// the cached page is still there
+	_, err = backend.WriteAt([]byte{2}, 1)
+	assert.Nil(t, err)
+	buf := make([]byte, 3)
+	_, err = backend.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 42}, buf)
+
+	store.failureRate = 0
+	err = backend.Trim(0, 2*pageSize)
+	assert.Nil(t, err)
+	assert.Equal(t, zero, backend.cache.brain.pages[0].state)
+	assert.Equal(t, zero, backend.cache.brain.pages[1].state)
+	assert.Equal(t, 0, backend.cache.brain.cacheCount)
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+}
+
+func TestReadDuringPrefetch(t *testing.T) {
+	const pageSize = 4096
+	localStore, dir := newTestStore(t, pageSize, 1)
+	defer os.RemoveAll(dir)
+
+	store := &slowStore{
+		LocalStore: localStore,
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:        2 * pageSize,
+		PageSize:    pageSize,
+		RemoteStore: store,
+	})
+
+	err := backend.Prefetch(pageSize, pageSize)
+	assert.Nil(t, err)
+	<-store.started
+
+	buf := make([]byte, 1)
+	done := make(chan error)
+	go func() {
+		_, err := backend.ReadAt(buf, pageSize)
+		done <- err
+	}()
+
+	// the read uses the prefetched page instead of downloading it again
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(waitInterval / 2):
+		t.Fatal("read did not pick up the prefetched page")
+	}
+	assert.Equal(t, []byte{42}, buf)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.downloads))
+	assert.Equal(t, cachedUnchanged, backend.cache.brain.pages[1].state)
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+}
+
+// crash leaves a backend behind like a crash of the server would, without
+// saving anything on the way.
+func crash(backend *Backend) {
+	backend.mutex.Lock()
+	backend.state = unavailable
+	backend.mutex.Unlock()
+}
+
+func TestDirtyMapAfterCrash(t *testing.T) {
+	const size = 4096
+	store, dir := newTestStore(t, size, 0)
+	defer os.RemoveAll(dir)
+
+	settings := BackendSettings{
+		Size:             size,
+		PageSize:         size,
+		DirtyGranularity: 1024,
+		RemoteStore:      store,
+	}
+	backend := newTestBackend(t, dir, settings)
+	dirtyPath := asDirtyPath(backend.cacheDirectory, 0)
+
+	// the map is saved together with the flushed cache file
+	_, err := backend.WriteAt([]byte{1}, 100)
+	assert.Nil(t, err)
+	assert.False(t, fileCanBeStated(dirtyPath))
+	err = backend.Flush()
+	assert.Nil(t, err)
+	assert.True(t, fileCanBeStated(dirtyPath))
+
+	// changes that the map already covers keep it
+	_, err = backend.WriteAt([]byte{2}, 200)
+	assert.Nil(t, err)
+	assert.True(t, fileCanBeStated(dirtyPath))
+
+	crash(backend)
+	backend = newTestBackend(t, dir, settings)
+	assert.Equal(t, cachedChanged, backend.cache.brain.pages[0].state)
+	assert.Equal(t, []PageRange{{Offset: 0, Length: 1024}},
+		backend.cache.pages[0].dirty.ranges(size))
+
+	// other changes remove it until the next flush
+	_, err = backend.WriteAt([]byte{3}, 2000)
+	assert.Nil(t, err)
+	assert.False(t, fileCanBeStated(dirtyPath))
+
+	crash(backend)
+	backend = newTestBackend(t, dir, settings)
+	assert.True(t, backend.cache.pages[0].dirty.all)
+
+	buf := make([]byte, 1)
+	_, err = backend.ReadAt(buf, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{3}, buf)
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
 }
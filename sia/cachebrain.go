@@ -15,6 +15,8 @@ type (
 		state            state
 		lastAccess       time.Time
 		lastPostponement time.Time
+		pinnedUntil      time.Time
+		prefetching      bool
 	}
 
 	lastAccessDetails struct {
@@ -25,6 +27,7 @@ type (
 	cacheBrain struct {
 		pageCount     int
 		cacheCount    int
+		prefetchCount int
 		hardMaxCached int
 		softMaxCached int
 		idleInterval  time.Duration
@@ -55,6 +58,11 @@ const (
 	postponeUpload
 	openFile
 	closeFile
+	deleteRemote
+	prefetch
+	usePrefetch
+	discardPrefetch
+	completeUpload
 	waitAndRetry
 )
 
@@ -67,6 +75,7 @@ func newCacheBrain(pageCount int, hardMaxCached int, softMaxCached int,
 	cacheBrain := cacheBrain{
 		pageCount:     pageCount,
 		cacheCount:    0,
+		prefetchCount: 0,
 		hardMaxCached: hardMaxCached,
 		softMaxCached: softMaxCached,
 		idleInterval:  idleInterval,
@@ -107,10 +116,13 @@ func (cb *cacheBrain) maintenance(now time.Time) []action {
 		recentlyPostponed := now.Before(
 			cb.pages[access.page].lastPostponement.Add(cb.idleInterval))
 		softLimitReached := cb.cacheCount >= cb.softMaxCached
+		// Pins are only a hint, which must not fill up the cache for good.
+		isPinned := now.Before(cb.pages[access.page].pinnedUntil) &&
+			cb.cacheCount < cb.hardMaxCached
 
 		switch cb.pages[access.page].state {
 		case cachedUnchanged:
-			if softLimitReached && !hasRecentActivity {
+			if softLimitReached && !hasRecentActivity && !isPinned {
 				actions = append(actions, action{
 					actionType: closeFile,
 					page:       access.page,
@@ -140,6 +152,14 @@ func (cb *cacheBrain) maintenance(now time.Time) []action {
 func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []action {
 	actions := []action{}
 
+	if cb.pages[page].state == notCached && cb.pages[page].prefetching {
+		// the page is already on its way, see completePrefetch
+		actions = append(actions, action{
+			actionType: waitAndRetry,
+		})
+		return actions
+	}
+
 	if !isCached(cb.pages[page].state) && cb.cacheCount >= cb.hardMaxCached {
 		// wait for maintenance to free up some space first
 		actions = append(actions, action{
@@ -198,6 +218,225 @@ func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []ac
 	return actions
 }
 
+// prepareTrim returns a page to the zero state if the whole page is being
+// trimmed. A partial trim only needs to be considered if the page is already
+// cached, in which case it is treated like a write.
+func (cb *cacheBrain) prepareTrim(page page, wholePage bool, now time.Time) []action {
+	actions := []action{}
+
+	if !wholePage {
+		if isCached(cb.pages[page].state) {
+			return cb.prepareAccess(page, true, now)
+		}
+		return actions
+	}
+
+	if cb.pages[page].state == zero {
+		return actions
+	}
+
+	actions = append(actions, action{
+		actionType: deleteRemote,
+		page:       page,
+	})
+
+	if isCached(cb.pages[page].state) {
+		actions = append(actions, action{
+			actionType: closeFile,
+			page:       page,
+		})
+		actions = append(actions, action{
+			actionType: deleteCache,
+			page:       page,
+		})
+		cb.cacheCount -= 1
+	}
+
+	cb.pages[page].state = zero
+	return actions
+}
+
+// prepareWriteZeroes avoids materializing pages where possible. The
+// returned flag tells whether the range still needs to be zeroed in the
+// cache file after the actions have been handled.
+func (cb *cacheBrain) prepareWriteZeroes(page page, wholePage bool, noHole bool,
+	now time.Time) ([]action, bool) {
+	actions := []action{}
+
+	switch {
+	case cb.pages[page].state == zero:
+		return actions, false
+	case wholePage && !noHole:
+		return cb.prepareTrim(page, true, now), false
+	case wholePage && cb.pages[page].state == notCached:
+		// no need to download a page that will be overwritten completely
+		if cb.cacheCount >= cb.hardMaxCached {
+			actions = append(actions, action{
+				actionType: waitAndRetry,
+			})
+			return actions, false
+		}
+
+		actions = append(actions, action{
+			actionType: openFile,
+			page:       page,
+		})
+		actions = append(actions, action{
+			actionType: zeroCache,
+			page:       page,
+		})
+		cb.pages[page].state = cachedChanged
+		cb.pages[page].lastAccess = now
+		cb.cacheCount += 1
+		return actions, false
+	default:
+		return cb.prepareAccess(page, true, now), true
+	}
+}
+
+// prepareSync starts the upload of a changed page right away and then waits
+// until the upload has completed. Pages that are not cached or unchanged are
+// already safely stored on Sia.
+func (cb *cacheBrain) prepareSync(page page) []action {
+	actions := []action{}
+
+	switch cb.pages[page].state {
+	case cachedChanged:
+		actions = append(actions, action{
+			actionType: startUpload,
+			page:       page,
+		})
+		actions = append(actions, action{
+			actionType: waitAndRetry,
+		})
+		cb.pages[page].state = cachedUploading
+	case cachedUploading:
+		actions = append(actions, action{
+			actionType: waitAndRetry,
+		})
+	}
+
+	return actions
+}
+
+// prepareCache is called for pages that a client is going to need soon. Pages
+// that are not cached yet are downloaded in the background, as long as the
+// cache is below the soft limit. Either way, the page is protected from
+// eviction for a while, unless the cache reaches the hard limit.
+func (cb *cacheBrain) prepareCache(page page, now time.Time) []action {
+	actions := []action{}
+
+	cb.pages[page].pinnedUntil = now.Add(pinInterval)
+
+	if cb.pages[page].state != notCached || cb.pages[page].prefetching {
+		return actions
+	}
+
+	if cb.cacheCount+cb.prefetchCount >= cb.softMaxCached {
+		return actions
+	}
+
+	actions = append(actions, action{
+		actionType: prefetch,
+		page:       page,
+	})
+	cb.pages[page].prefetching = true
+	cb.prefetchCount += 1
+	return actions
+}
+
+// completePrefetch decides what to do with a page that has been downloaded in
+// the background. It is only moved into the cache if nobody else has dealt
+// with the page in the meantime.
+func (cb *cacheBrain) completePrefetch(page page, downloaded bool, now time.Time) []action {
+	actions := []action{}
+
+	cb.pages[page].prefetching = false
+	cb.prefetchCount -= 1
+
+	if !downloaded || cb.pages[page].state != notCached || cb.cacheCount >= cb.hardMaxCached {
+		actions = append(actions, action{
+			actionType: discardPrefetch,
+			page:       page,
+		})
+		return actions
+	}
+
+	actions = append(actions, action{
+		actionType: usePrefetch,
+		page:       page,
+	})
+	actions = append(actions, action{
+		actionType: openFile,
+		page:       page,
+	})
+	cb.pages[page].state = cachedUnchanged
+	cb.pages[page].lastAccess = now
+	cb.cacheCount += 1
+	return actions
+}
+
+// abortAccess undoes a decision to bring a page into the cache after that
+// has failed, so that the next access tries again. It reports whether there
+// was anything to undo.
+func (cb *cacheBrain) abortAccess(page page, previous state) bool {
+	if isCached(previous) || !isCached(cb.pages[page].state) {
+		return false
+	}
+
+	cb.pages[page].state = previous
+	cb.cacheCount -= 1
+	return true
+}
+
+// abortTrim undoes a decision to return a page to the zero state after the
+// remote copy could not be deleted. It is unknown whether the remote copy is
+// still intact, so a page that is still cached counts as changed. It reports
+// whether there was anything to undo.
+func (cb *cacheBrain) abortTrim(page page, previous state, cached bool) bool {
+	if cb.pages[page].state != zero || previous == zero {
+		return false
+	}
+
+	switch {
+	case cached:
+		cb.pages[page].state = cachedChanged
+		cb.cacheCount += 1
+	case previous == notCached:
+		cb.pages[page].state = notCached
+	default:
+		// the cache file is gone already, but so is the remote copy
+		return false
+	}
+	return true
+}
+
+// abortUpload is called if an upload could not be started. The page counts
+// as changed again, so that maintenance tries once more.
+func (cb *cacheBrain) abortUpload(page page) {
+	if cb.pages[page].state == cachedUploading {
+		cb.pages[page].state = cachedChanged
+	}
+}
+
+// completeUpload is called once the upload of a page has reached sufficient
+// redundancy. Changes that came in while uploading have postponed the upload,
+// so the cache matches the remote copy again.
+func (cb *cacheBrain) completeUpload(page page) []action {
+	actions := []action{}
+
+	if cb.pages[page].state != cachedUploading {
+		return actions
+	}
+
+	actions = append(actions, action{
+		actionType: completeUpload,
+		page:       page,
+	})
+	cb.pages[page].state = cachedUnchanged
+	return actions
+}
+
 func (cb *cacheBrain) prepareShutdown(thorough bool) []action {
 	actions := []action{}
 
@@ -242,6 +481,23 @@ func (cb *cacheBrain) prepareShutdown(thorough bool) []action {
 	return actions
 }
 
+func asCacheState(state state) CacheState {
+	switch state {
+	case zero:
+		return CacheStateZero
+	case notCached:
+		return CacheStateNotCached
+	case cachedUnchanged:
+		return CacheStateCachedUnchanged
+	case cachedChanged:
+		return CacheStateCachedChanged
+	case cachedUploading:
+		return CacheStateCachedUploading
+	default:
+		panic("unknown state")
+	}
+}
+
 func isCached(state state) bool {
 	return state == cachedUnchanged || state == cachedChanged || state == cachedUploading
 }
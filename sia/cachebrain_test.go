@@ -323,3 +323,256 @@ func TestPrepareThoroughShutdown(t *testing.T) {
 	assert.Equal(t, cachedUploading, cacheBrain.pages[3].state)
 	assert.Equal(t, waitAndRetry, actions[1].actionType)
 }
+
+func TestPrepareTrim(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 6, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	actions := cacheBrain.prepareTrim(page(1), true, now)
+	assert.Empty(t, actions, "trimming a zero page should do nothing")
+	assert.Equal(t, zero, cacheBrain.pages[1].state)
+
+	cacheBrain.pages[2].state = notCached
+	actions = cacheBrain.prepareTrim(page(2), false, now)
+	assert.Empty(t, actions, "partial trim of uncached page should do nothing")
+	assert.Equal(t, notCached, cacheBrain.pages[2].state)
+
+	actions = cacheBrain.prepareTrim(page(2), true, now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, deleteRemote, actions[0].actionType)
+	assert.Equal(t, zero, cacheBrain.pages[2].state)
+
+	cacheBrain.pages[3].state = cachedUnchanged
+	cacheBrain.pages[3].lastAccess = now
+	cacheBrain.cacheCount = 1
+	actions = cacheBrain.prepareTrim(page(3), false, now)
+	assert.Empty(t, actions)
+	assert.Equal(t, cachedChanged, cacheBrain.pages[3].state, "partial trim should count as write")
+
+	cacheBrain.pages[3].state = cachedUploading
+	actions = cacheBrain.prepareTrim(page(3), true, now)
+	assert.Equal(t, 3, len(actions))
+	assert.Equal(t, deleteRemote, actions[0].actionType)
+	assert.Equal(t, closeFile, actions[1].actionType)
+	assert.Equal(t, deleteCache, actions[2].actionType)
+	assert.Equal(t, zero, cacheBrain.pages[3].state)
+	assert.Equal(t, 0, cacheBrain.cacheCount)
+}
+
+func TestPrepareWriteZeroes(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 2, 1, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	actions, zeroRange := cacheBrain.prepareWriteZeroes(page(1), false, true, now)
+	assert.Empty(t, actions, "zeroing a zero page should do nothing")
+	assert.False(t, zeroRange)
+	assert.Equal(t, zero, cacheBrain.pages[1].state)
+
+	cacheBrain.pages[2].state = notCached
+	actions, zeroRange = cacheBrain.prepareWriteZeroes(page(2), true, false, now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, deleteRemote, actions[0].actionType)
+	assert.False(t, zeroRange)
+	assert.Equal(t, zero, cacheBrain.pages[2].state)
+
+	cacheBrain.pages[3].state = notCached
+	actions, zeroRange = cacheBrain.prepareWriteZeroes(page(3), true, true, now)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, openFile, actions[0].actionType)
+	assert.Equal(t, zeroCache, actions[1].actionType)
+	assert.False(t, zeroRange, "page should not be downloaded and zeroed again")
+	assert.Equal(t, cachedChanged, cacheBrain.pages[3].state)
+	assert.Equal(t, 1, cacheBrain.cacheCount)
+
+	cacheBrain.pages[4].state = notCached
+	actions, zeroRange = cacheBrain.prepareWriteZeroes(page(4), false, false, now)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, download, actions[0].actionType)
+	assert.Equal(t, openFile, actions[1].actionType)
+	assert.True(t, zeroRange)
+	assert.Equal(t, cachedChanged, cacheBrain.pages[4].state)
+	assert.Equal(t, 2, cacheBrain.cacheCount)
+
+	cacheBrain.pages[5].state = notCached
+	actions, _ = cacheBrain.prepareWriteZeroes(page(5), true, true, now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, waitAndRetry, actions[0].actionType)
+}
+
+func TestPrepareSync(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 2, 1, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := cacheBrain.prepareSync(page(1))
+	assert.Empty(t, actions, "a zero page needs no upload")
+
+	cacheBrain.pages[2].state = cachedUnchanged
+	actions = cacheBrain.prepareSync(page(2))
+	assert.Empty(t, actions, "an unchanged page is already on Sia")
+
+	cacheBrain.pages[3].state = cachedChanged
+	actions = cacheBrain.prepareSync(page(3))
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, startUpload, actions[0].actionType)
+	assert.Equal(t, waitAndRetry, actions[1].actionType)
+	assert.Equal(t, cachedUploading, cacheBrain.pages[3].state)
+
+	actions = cacheBrain.prepareSync(page(3))
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, waitAndRetry, actions[0].actionType)
+
+	// a failed upload is started again
+	cacheBrain.abortUpload(page(3))
+	assert.Equal(t, cachedChanged, cacheBrain.pages[3].state)
+	actions = cacheBrain.prepareSync(page(3))
+	assert.Equal(t, startUpload, actions[0].actionType)
+
+	// maintenance notices the completed upload
+	actions = cacheBrain.completeUpload(page(3))
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, completeUpload, actions[0].actionType)
+	assert.Equal(t, cachedUnchanged, cacheBrain.pages[3].state)
+	actions = cacheBrain.prepareSync(page(3))
+	assert.Empty(t, actions)
+
+	actions = cacheBrain.completeUpload(page(3))
+	assert.Empty(t, actions, "page is no longer uploading")
+}
+
+func TestPrepareCache(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 3, 2, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	actions := cacheBrain.prepareCache(page(1), now)
+	assert.Empty(t, actions, "a zero page needs no download")
+
+	cacheBrain.pages[2].state = notCached
+	actions = cacheBrain.prepareCache(page(2), now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, prefetch, actions[0].actionType)
+	assert.True(t, cacheBrain.pages[2].prefetching)
+
+	actions = cacheBrain.prepareCache(page(2), now)
+	assert.Empty(t, actions, "page is already being prefetched")
+
+	cacheBrain.pages[3].state = notCached
+	actions = cacheBrain.prepareCache(page(3), now)
+	assert.Equal(t, 1, len(actions))
+
+	cacheBrain.pages[4].state = notCached
+	actions = cacheBrain.prepareCache(page(4), now)
+	assert.Empty(t, actions, "prefetching stops at the soft limit")
+
+	actions = cacheBrain.completePrefetch(page(2), true, now)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, usePrefetch, actions[0].actionType)
+	assert.Equal(t, openFile, actions[1].actionType)
+	assert.Equal(t, cachedUnchanged, cacheBrain.pages[2].state)
+	assert.Equal(t, 1, cacheBrain.cacheCount)
+
+	// accesses wait for the prefetch instead of downloading again
+	actions = cacheBrain.prepareAccess(page(3), false, now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, waitAndRetry, actions[0].actionType)
+	assert.Equal(t, notCached, cacheBrain.pages[3].state)
+
+	// page 3 has been trimmed in the meantime
+	cacheBrain.prepareTrim(page(3), true, now)
+	actions = cacheBrain.completePrefetch(page(3), true, now)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, discardPrefetch, actions[0].actionType)
+	assert.Equal(t, 0, cacheBrain.prefetchCount)
+
+	// pinned pages are not evicted
+	cacheBrain.pages[5].state = cachedUnchanged
+	cacheBrain.cacheCount += 1
+	actions = cacheBrain.prepareCache(page(5), now)
+	assert.Empty(t, actions)
+	actions = cacheBrain.maintenance(now)
+	assert.Empty(t, actions)
+
+	// unless the cache is full
+	cacheBrain.pages[6].state = cachedUnchanged
+	cacheBrain.cacheCount += 1
+	cacheBrain.prepareCache(page(6), now)
+	actions = cacheBrain.maintenance(now)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, deleteCache, actions[1].actionType)
+	assert.Equal(t, 2, cacheBrain.cacheCount)
+
+	actions = cacheBrain.maintenance(now.Add(pinInterval + time.Second))
+	assert.NotEmpty(t, actions)
+}
+
+func TestAbortAccess(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 2, 1, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	cacheBrain.pages[1].state = notCached
+	cacheBrain.prepareAccess(page(1), true, now)
+	assert.Equal(t, cachedChanged, cacheBrain.pages[1].state)
+	assert.True(t, cacheBrain.abortAccess(page(1), notCached))
+	assert.Equal(t, notCached, cacheBrain.pages[1].state)
+	assert.Equal(t, 0, cacheBrain.cacheCount)
+
+	cacheBrain.prepareAccess(page(2), false, now)
+	assert.True(t, cacheBrain.abortAccess(page(2), zero))
+	assert.Equal(t, zero, cacheBrain.pages[2].state)
+	assert.Equal(t, 0, cacheBrain.cacheCount)
+
+	// pages that were cached before stay cached
+	cacheBrain.prepareAccess(page(3), false, now)
+	assert.False(t, cacheBrain.abortAccess(page(3), cachedChanged))
+	assert.Equal(t, cachedChanged, cacheBrain.pages[3].state)
+	assert.False(t, cacheBrain.abortAccess(page(4), zero))
+	assert.Equal(t, 1, cacheBrain.cacheCount)
+}
+
+func TestAbortTrim(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 3, 2, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	cacheBrain.prepareAccess(page(1), false, now)
+	cacheBrain.pages[1].state = cachedUnchanged
+	cacheBrain.prepareTrim(page(1), true, now)
+	assert.Equal(t, 0, cacheBrain.cacheCount)
+	assert.True(t, cacheBrain.abortTrim(page(1), cachedUnchanged, true))
+	assert.Equal(t, cachedChanged, cacheBrain.pages[1].state)
+	assert.Equal(t, 1, cacheBrain.cacheCount)
+
+	cacheBrain.pages[2].state = notCached
+	cacheBrain.prepareTrim(page(2), true, now)
+	assert.True(t, cacheBrain.abortTrim(page(2), notCached, false))
+	assert.Equal(t, notCached, cacheBrain.pages[2].state)
+
+	// a page without cache file or remote copy is zero after all
+	cacheBrain.prepareAccess(page(3), false, now)
+	cacheBrain.prepareTrim(page(3), true, now)
+	assert.False(t, cacheBrain.abortTrim(page(3), cachedChanged, false))
+	assert.Equal(t, zero, cacheBrain.pages[3].state)
+	assert.False(t, cacheBrain.abortTrim(page(4), zero, false))
+	assert.False(t, cacheBrain.abortTrim(page(1), zero, true))
+	assert.Equal(t, 1, cacheBrain.cacheCount)
+}
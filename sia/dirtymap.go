@@ -0,0 +1,134 @@
+package sia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+)
+
+// dirtyMap tracks which blocks of a cached page differ from the copy in the
+// remote store. If there is no such copy, or it is unknown which blocks
+// differ, the whole page is dirty.
+type dirtyMap struct {
+	granularity int64
+	all         bool
+	blocks      []byte
+}
+
+func newDirtyMap(pageSize int64, granularity int64, all bool) *dirtyMap {
+	blockCount := (pageSize + granularity - 1) / granularity
+	return &dirtyMap{
+		granularity: granularity,
+		all:         all,
+		blocks:      make([]byte, (blockCount+7)/8),
+	}
+}
+
+// mark records that the given range of the page has changed.
+func (dm *dirtyMap) mark(offset int64, length int64) {
+	if length <= 0 {
+		return
+	}
+
+	for block := offset / dm.granularity; block <= (offset+length-1)/dm.granularity; block++ {
+		dm.blocks[block/8] |= 1 << uint(block%8)
+	}
+}
+
+// covers tells whether the given range of the page is already marked.
+func (dm *dirtyMap) covers(offset int64, length int64) bool {
+	if length <= 0 {
+		return true
+	}
+
+	for block := offset / dm.granularity; block <= (offset+length-1)/dm.granularity; block++ {
+		if !dm.isDirty(block) {
+			return false
+		}
+	}
+	return true
+}
+
+func (dm *dirtyMap) markAll() {
+	dm.all = true
+}
+
+// clear is called once the page has been uploaded.
+func (dm *dirtyMap) clear() {
+	dm.all = false
+	for i := range dm.blocks {
+		dm.blocks[i] = 0
+	}
+}
+
+func (dm *dirtyMap) isDirty(block int64) bool {
+	return dm.all || dm.blocks[block/8]&(1<<uint(block%8)) != 0
+}
+
+// ranges combines neighbouring dirty blocks. Ranges are cut off at the
+// given length of the page.
+func (dm *dirtyMap) ranges(pageLength int64) []PageRange {
+	ranges := []PageRange{}
+
+	for block := int64(0); block*dm.granularity < pageLength; block++ {
+		if !dm.isDirty(block) {
+			continue
+		}
+
+		offset := block * dm.granularity
+		length := min64(dm.granularity, pageLength-offset)
+		if len(ranges) > 0 && ranges[len(ranges)-1].Offset+ranges[len(ranges)-1].Length == offset {
+			ranges[len(ranges)-1].Length += length
+		} else {
+			ranges = append(ranges, PageRange{Offset: offset, Length: length})
+		}
+	}
+
+	return ranges
+}
+
+// save stores the map next to the cache file. The granularity goes first, so
+// that a map is not misread after the setting has been changed, and a map that
+// did not fully reach the disk is not used either.
+func (dm *dirtyMap) save(path string) error {
+	data := make([]byte, 8, 8+len(dm.blocks))
+	binary.BigEndian.PutUint64(data, uint64(dm.granularity))
+	if dm.all {
+		data = append(data, allDirtyBlocks(len(dm.blocks))...)
+	} else {
+		data = append(data, dm.blocks...)
+	}
+
+	return writeFileAtomically(path, bytes.NewReader(data))
+}
+
+// loadDirtyMap reads a map that has been saved on shutdown. The whole page
+// is considered dirty if there is no usable map.
+func loadDirtyMap(path string, pageSize int64, granularity int64) (*dirtyMap, error) {
+	dm := newDirtyMap(pageSize, granularity, true)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return dm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != 8+len(dm.blocks) || binary.BigEndian.Uint64(data) != uint64(granularity) {
+		return dm, nil
+	}
+
+	dm.all = false
+	copy(dm.blocks, data[8:])
+	return dm, nil
+}
+
+func allDirtyBlocks(length int) []byte {
+	blocks := make([]byte, length)
+	for i := range blocks {
+		blocks[i] = 0xff
+	}
+	return blocks
+}
@@ -0,0 +1,69 @@
+package sia
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirtyMap(t *testing.T) {
+	dm := newDirtyMap(10000, 1000, false)
+	assert.Equal(t, []PageRange{}, dm.ranges(10000))
+
+	dm.mark(999, 2)
+	dm.mark(3000, 1000)
+	dm.mark(9500, 10)
+	dm.mark(5000, 0)
+	assert.Equal(t, []PageRange{
+		{Offset: 0, Length: 2000},
+		{Offset: 3000, Length: 1000},
+		{Offset: 9000, Length: 1000},
+	}, dm.ranges(10000))
+
+	assert.True(t, dm.covers(1500, 500))
+	assert.True(t, dm.covers(5000, 0))
+	assert.False(t, dm.covers(1500, 1000))
+
+	// the last page of a device can be shorter
+	assert.Equal(t, []PageRange{
+		{Offset: 0, Length: 2000},
+		{Offset: 3000, Length: 1000},
+	}, dm.ranges(4500))
+
+	dm.markAll()
+	assert.Equal(t, []PageRange{{Offset: 0, Length: 10000}}, dm.ranges(10000))
+
+	dm.clear()
+	assert.Equal(t, []PageRange{}, dm.ranges(10000))
+}
+
+func TestSaveDirtyMap(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "page0.dirty")
+
+	// without a saved map, the whole page is dirty
+	dm, err := loadDirtyMap(path, 10000, 1000)
+	assert.Nil(t, err)
+	assert.True(t, dm.all)
+
+	dm = newDirtyMap(10000, 1000, false)
+	dm.mark(4000, 1)
+	err = dm.save(path)
+	assert.Nil(t, err)
+
+	loaded, err := loadDirtyMap(path, 10000, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, dm, loaded)
+
+	// a map with a different granularity is of no use
+	loaded, err = loadDirtyMap(path, 10000, 500)
+	assert.Nil(t, err)
+	assert.True(t, loaded.all)
+
+	err = removeLeftovers(dir, "page*.dirty")
+	assert.Nil(t, err)
+	assert.False(t, fileCanBeStated(path))
+}
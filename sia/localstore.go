@@ -0,0 +1,275 @@
+package sia
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+type (
+	// LocalStore keeps pages in a local directory and behaves roughly like
+	// the Sia renter: uploads take a while to reach full redundancy and
+	// operations fail every now and then. It is meant for development and
+	// testing without a Sia node.
+	LocalStore struct {
+		directory   string
+		latency     time.Duration
+		redundancy  float64
+		failureRate float64
+		now         func() time.Time
+	}
+
+	LocalStoreSettings struct {
+		// Directory is where the pages are stored.
+		Directory string
+
+		// Latency is how long a download takes and how long it takes
+		// an upload to reach full redundancy.
+		Latency time.Duration
+
+		// Redundancy is what uploads reach in the end. It defaults to
+		// localRedundancy.
+		Redundancy float64
+
+		// FailureRate is the probability (0 to 1) with which an
+		// operation fails.
+		FailureRate float64
+	}
+)
+
+// localRedundancy is the default redundancy of a page once the upload is
+// complete.
+const localRedundancy = 3.0
+
+// downloadSuffix marks files that are still being downloaded.
+const downloadSuffix = ".download"
+
+var errInjectedFailure = fmt.Errorf("injected failure of local store: %w", syscall.EIO)
+
+func NewLocalStore(settings LocalStoreSettings) (*LocalStore, error) {
+	if settings.FailureRate < 0 || settings.FailureRate > 1 {
+		return nil, fmt.Errorf("failure rate %f is not between 0 and 1", settings.FailureRate)
+	}
+
+	if settings.Redundancy == 0 {
+		settings.Redundancy = localRedundancy
+	}
+
+	err := os.MkdirAll(settings.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{
+		directory:   settings.Directory,
+		latency:     settings.Latency,
+		redundancy:  settings.Redundancy,
+		failureRate: settings.FailureRate,
+		now:         time.Now,
+	}, nil
+}
+
+// PutPage copies the page right away, so that later changes to the file do
+// not affect it. The modification time of the copy marks the start of the
+// upload, from which its redundancy is derived.
+func (ls *LocalStore) PutPage(page int, path string) error {
+	if ls.fail() {
+		return errInjectedFailure
+	}
+
+	pagePath := ls.asPagePath(page)
+	err := copyFile(path, pagePath+".upload")
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(pagePath+".upload", pagePath)
+}
+
+// PutPageRanges patches a copy of the stored page and then replaces it, so
+// that the upload starts over just like with PutPage.
+func (ls *LocalStore) PutPageRanges(page int, path string, ranges []PageRange) error {
+	if ls.fail() {
+		return errInjectedFailure
+	}
+
+	pagePath := ls.asPagePath(page)
+	err := copyFile(pagePath, pagePath+".upload")
+	if err != nil {
+		return err
+	}
+
+	err = patchFile(path, pagePath+".upload", ranges)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(pagePath+".upload", pagePath)
+}
+
+func (ls *LocalStore) GetPage(page int, path string) error {
+	time.Sleep(ls.latency)
+
+	if ls.fail() {
+		return errInjectedFailure
+	}
+
+	in, err := os.Open(ls.asPagePath(page))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeFileAtomically(path, in)
+}
+
+func (ls *LocalStore) DeletePage(page int) error {
+	if ls.fail() {
+		return errInjectedFailure
+	}
+
+	err := os.Remove(ls.asPagePath(page))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListPages lets the redundancy of each page grow linearly, until it reaches
+// its final value once the latency has passed. Like on Sia, a page becomes
+// recoverable once its redundancy reaches 1.
+func (ls *LocalStore) ListPages() ([]RemotePage, error) {
+	pages := []RemotePage{}
+
+	if ls.fail() {
+		return pages, errInjectedFailure
+	}
+
+	fileInfos, err := ioutil.ReadDir(ls.directory)
+	if err != nil {
+		return pages, err
+	}
+
+	for _, fileInfo := range fileInfos {
+		var page int
+		_, err := fmt.Sscanf(fileInfo.Name(), "page%d", &page)
+		if err != nil || fileInfo.Name() != fmt.Sprintf("page%d", page) {
+			continue
+		}
+
+		redundancy := ls.redundancy
+		if ls.latency > 0 {
+			age := ls.now().Sub(fileInfo.ModTime())
+			progress := float64(age) / float64(ls.latency)
+			if progress < 1 {
+				redundancy = ls.redundancy * progress
+			}
+		}
+
+		pages = append(pages, RemotePage{
+			Page:        page,
+			Recoverable: redundancy >= 1,
+			Redundancy:  redundancy,
+		})
+	}
+
+	return pages, nil
+}
+
+func (ls *LocalStore) PutMetadata(path string) error {
+	if ls.fail() {
+		return errInjectedFailure
+	}
+
+	return copyFile(path, filepath.Join(ls.directory, metadataFile))
+}
+
+func (ls *LocalStore) GetMetadata(path string) (bool, error) {
+	if ls.fail() {
+		return false, errInjectedFailure
+	}
+
+	err := copyFile(filepath.Join(ls.directory, metadataFile), path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ls *LocalStore) fail() bool {
+	return ls.failureRate > 0 && rand.Float64() < ls.failureRate
+}
+
+func (ls *LocalStore) asPagePath(page int) string {
+	return filepath.Join(ls.directory, fmt.Sprintf("page%d", page))
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeFile(destination, in)
+}
+
+// patchFile copies the given ranges from one file to the other.
+func patchFile(source string, destination string, ranges []PageRange) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		buf := make([]byte, r.Length)
+		_, err = in.ReadAt(buf, r.Offset)
+		if err == nil {
+			_, err = out.WriteAt(buf, r.Offset)
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// writeFileAtomically only lets the file appear once it is complete, so that
+// an interrupted download does not leave a truncated page behind.
+func writeFileAtomically(path string, r io.Reader) error {
+	err := writeFile(path+downloadSuffix, r)
+	if err != nil {
+		os.Remove(path + downloadSuffix)
+		return err
+	}
+
+	return os.Rename(path+downloadSuffix, path)
+}
+
+func writeFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
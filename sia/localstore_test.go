@@ -0,0 +1,276 @@
+package sia
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLocalStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(LocalStoreSettings{
+		Directory: filepath.Join(dir, "store"),
+		Latency:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(dir, "source")
+	err = ioutil.WriteFile(source, []byte("page data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.PutPage(3, source)
+	assert.Nil(t, err)
+
+	// leftovers of interrupted uploads are not pages
+	err = ioutil.WriteFile(filepath.Join(dir, "store", "page4.upload"), []byte{}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// redundancy grows over time
+	start := time.Now()
+	store.now = func() time.Time { return start.Add(10 * time.Second) }
+	pages, err := store.ListPages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pages))
+	assert.Equal(t, 3, pages[0].Page)
+	assert.False(t, pages[0].Recoverable)
+	assert.InDelta(t, 0.5, pages[0].Redundancy, 0.01)
+
+	store.now = func() time.Time { return start.Add(time.Minute) }
+	pages, err = store.ListPages()
+	assert.Nil(t, err)
+	assert.True(t, pages[0].Recoverable)
+	assert.Equal(t, localRedundancy, pages[0].Redundancy)
+
+	store.latency = 0
+	destination := filepath.Join(dir, "destination")
+	err = store.GetPage(3, destination)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(destination)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("page data"), data)
+
+	err = store.DeletePage(3)
+	assert.Nil(t, err)
+	err = store.DeletePage(3)
+	assert.Nil(t, err)
+	pages, err = store.ListPages()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(pages))
+}
+
+func TestLocalStoreFailures(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := NewLocalStore(LocalStoreSettings{Directory: dir, FailureRate: 2})
+	assert.NotNil(t, err)
+
+	store, err := NewLocalStore(LocalStoreSettings{Directory: dir, FailureRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.DeletePage(0)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	_, err = store.ListPages()
+	assert.True(t, errors.Is(err, syscall.EIO))
+}
+
+// TestLocalStoreBackend runs a backend on top of a local store, which covers
+// everything from the NBD requests down to the remote store.
+func TestLocalStoreBackend(t *testing.T) {
+	const size = 4096
+	store, dir := newTestStore(t, size, 0)
+	defer os.RemoveAll(dir)
+
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:             size,
+		PageSize:         size,
+		DirtyGranularity: 1024,
+		RemoteStore:      store,
+	})
+
+	// the page is downloaded on first access
+	buf := make([]byte, 4)
+	n, err := backend.ReadAt(buf, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte{42, 42, 42, 42}, buf)
+
+	// rewriting the same data does not change the page
+	_, err = backend.WriteAt([]byte{42, 42}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, cachedUnchanged, backend.cache.brain.pages[0].state)
+
+	_, err = backend.WriteAt([]byte{1, 2}, 100)
+	assert.Nil(t, err)
+	n, err = backend.ReadAt(buf, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 42, 42}, buf)
+	assert.Equal(t, cachedChanged, backend.cache.brain.pages[0].state)
+	assert.Equal(t, []PageRange{{Offset: 0, Length: 1024}},
+		backend.cache.pages[0].dirty.ranges(size))
+
+	// only the changed block is sent to the store
+	err = ioutil.WriteFile(store.asPagePath(0), bytes.Repeat([]byte{7}, size), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.upload(0)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(store.asPagePath(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{42, 1, 2, 42}, data[99:103])
+	assert.Equal(t, []byte{42, 7}, data[1023:1025])
+
+	// discarding the whole page removes it from the store
+	err = backend.Trim(0, size)
+	assert.Nil(t, err)
+	pages, err := store.ListPages()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(pages))
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+}
+
+// slowStore holds up downloads of page 1 until it is released. It counts
+// how often page 1 has been downloaded.
+type slowStore struct {
+	*LocalStore
+	started   chan struct{}
+	release   chan struct{}
+	downloads int32
+}
+
+func (ss *slowStore) GetPage(page int, path string) error {
+	if page == 1 {
+		if atomic.AddInt32(&ss.downloads, 1) == 1 {
+			close(ss.started)
+		}
+		<-ss.release
+	}
+	return ss.LocalStore.GetPage(page, path)
+}
+
+func TestSlowDownload(t *testing.T) {
+	const pageSize = 4096
+	localStore, dir := newTestStore(t, pageSize, 1)
+	defer os.RemoveAll(dir)
+
+	store := &slowStore{
+		LocalStore: localStore,
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:        2 * pageSize,
+		PageSize:    pageSize,
+		RemoteStore: store,
+	})
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := backend.ReadAt(buf, pageSize)
+		done <- err
+	}()
+	<-store.started
+
+	// the download of page 1 does not hold up other pages
+	_, err := backend.WriteAt([]byte{1}, 0)
+	assert.Nil(t, err)
+	buf := make([]byte, 1)
+	_, err = backend.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, buf)
+	assert.Equal(t, 1, len(backend.Extents(0, pageSize)))
+
+	// and neither does a flush
+	err = backend.Flush()
+	assert.Nil(t, err)
+	err = backend.Sync(0, 2*pageSize)
+	assert.Nil(t, err)
+
+	close(store.release)
+	assert.Nil(t, <-done)
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+}
+
+// TestLocalStoreBackendFailures makes sure that the backend recovers once the
+// remote store works again.
+func TestLocalStoreBackendFailures(t *testing.T) {
+	const size = 4096
+	store, dir := newTestStore(t, size, 0)
+	defer os.RemoveAll(dir)
+
+	backend := newTestBackend(t, dir, BackendSettings{
+		Size:         size,
+		PageSize:     size,
+		RemoteStore:  store,
+		IdleInterval: time.Nanosecond,
+	})
+
+	// a failed download leaves the page as it was
+	store.failureRate = 1
+	buf := make([]byte, 4)
+	_, err := backend.ReadAt(buf, 100)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.Equal(t, notCached, backend.cache.brain.pages[0].state)
+	assert.Equal(t, 0, backend.cache.brain.cacheCount)
+	assert.False(t, fileCanBeStated(asCachePath(backend.cacheDirectory, 0)))
+
+	err = backend.WriteZeroes(100, 4, false)
+	assert.True(t, errors.Is(err, syscall.EIO))
+
+	store.failureRate = 0
+	n, err := backend.ReadAt(buf, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte{42, 42, 42, 42}, buf)
+
+	// a failed upload is retried by the next maintenance
+	_, err = backend.WriteAt([]byte{1, 2}, 100)
+	assert.Nil(t, err)
+	store.failureRate = 1
+	err = backend.maintenance()
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.Equal(t, cachedChanged, backend.cache.brain.pages[0].state)
+
+	store.failureRate = 0
+	err = backend.maintenance()
+	assert.Nil(t, err)
+	assert.Equal(t, cachedUnchanged, backend.cache.brain.pages[0].state)
+	data, err := ioutil.ReadFile(store.asPagePath(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 42, 42}, data[100:104])
+
+	err = backend.Shutdown(false)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,177 @@
+package sia
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// metadata is recorded for every volume, both in the cache directory and in
+// the remote store. It holds the settings that can not change once data has
+// been written, as that would garble the volume.
+type metadata struct {
+	PageSize int64 `json:"pageSize"`
+}
+
+const (
+	metadataFile = "metadata.json"
+
+	// legacyPageSize is the page size of volumes that were created before
+	// metadata was recorded.
+	legacyPageSize = 64 * 1024 * 1024
+)
+
+// checkMetadata makes sure that the volume is opened with the page size it
+// was created with. Missing records are written, unless the volume is opened
+// read-only.
+func checkMetadata(settings BackendSettings) error {
+	expected := metadata{PageSize: int64(settings.PageSize)}
+	localPath := filepath.Join(settings.CacheDirectory, metadataFile)
+
+	local, localFound, err := readMetadata(localPath)
+	if err != nil {
+		return err
+	}
+
+	remotePath := localPath + ".remote"
+	remote, remoteFound, err := fetchMetadata(settings.RemoteStore, remotePath)
+	if err != nil {
+		if !localFound {
+			return err
+		}
+
+		// The record might still be uploading, e.g. after a restart
+		// right after the volume was created.
+		log.Printf("Unable to check metadata in remote store: %s\n", err)
+	}
+
+	records := []metadata{}
+	if localFound {
+		records = append(records, local)
+	}
+	if remoteFound {
+		records = append(records, remote)
+	}
+
+	if len(records) == 0 {
+		legacy, err := hasPages(settings.RemoteStore, settings.CacheDirectory)
+		if err != nil {
+			return err
+		}
+
+		if legacy {
+			log.Printf("Volume has no metadata - assuming it was created with %d byte pages\n",
+				legacyPageSize)
+			records = append(records, metadata{PageSize: legacyPageSize})
+		}
+	}
+
+	for _, record := range records {
+		if record.PageSize != expected.PageSize {
+			return fmt.Errorf("volume was created with a page size of %d bytes, but %d are configured",
+				record.PageSize, expected.PageSize)
+		}
+	}
+
+	if settings.ReadOnly {
+		return nil
+	}
+
+	if !localFound {
+		err = writeMetadata(localPath, expected)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !remoteFound {
+		log.Printf("Storing metadata in remote store\n")
+		err = settings.RemoteStore.PutMetadata(localPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fetchMetadata(store RemoteStore, path string) (metadata, bool, error) {
+	found, err := store.GetMetadata(path)
+	if err != nil || !found {
+		return metadata{}, false, err
+	}
+	defer os.Remove(path)
+
+	return readMetadata(path)
+}
+
+func readMetadata(path string) (metadata, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return metadata{}, false, nil
+	}
+	if err != nil {
+		return metadata{}, false, err
+	}
+
+	var record metadata
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return metadata{}, false, fmt.Errorf("invalid metadata in %s: %w", path, err)
+	}
+
+	return record, true, nil
+}
+
+// writeMetadata replaces the file in one step and syncs it, just like the
+// cache files are synced on a flush.
+func writeMetadata(path string, record metadata) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(path))
+}
+
+// hasPages tells whether any data has been written to the volume so far.
+func hasPages(store RemoteStore, cacheDirectory string) (bool, error) {
+	remotePages, err := store.ListPages()
+	if err != nil {
+		return false, err
+	}
+
+	cachePaths, err := filepath.Glob(filepath.Join(cacheDirectory, "page*"))
+	if err != nil {
+		return false, err
+	}
+
+	return len(remotePages) > 0 || len(cachePaths) > 0, nil
+}
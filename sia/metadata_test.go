@@ -0,0 +1,105 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMetadata(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(LocalStoreSettings{Directory: filepath.Join(dir, "store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := BackendSettings{
+		PageSize:         4096,
+		DirtyGranularity: 4096,
+		RemoteStore:      store,
+		CacheDirectory:   filepath.Join(dir, "cache"),
+	}
+	err = os.MkdirAll(settings.CacheDirectory, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new volume gets both records
+	err = checkMetadata(settings)
+	assert.Nil(t, err)
+	for _, path := range []string{
+		filepath.Join(settings.CacheDirectory, metadataFile),
+		filepath.Join(dir, "store", metadataFile),
+	} {
+		record, found, err := readMetadata(path)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, metadata{PageSize: 4096}, record)
+	}
+
+	err = checkMetadata(settings)
+	assert.Nil(t, err)
+
+	settings.PageSize = 8192
+	err = checkMetadata(settings)
+	assert.NotNil(t, err)
+
+	// the remote record is enough to notice
+	err = os.Remove(filepath.Join(settings.CacheDirectory, metadataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkMetadata(settings)
+	assert.NotNil(t, err)
+	_, found, err := readMetadata(filepath.Join(settings.CacheDirectory, metadataFile))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestCheckMetadataLegacy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(LocalStoreSettings{Directory: filepath.Join(dir, "store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := BackendSettings{
+		PageSize:         4096,
+		DirtyGranularity: 4096,
+		RemoteStore:      store,
+		CacheDirectory:   filepath.Join(dir, "cache"),
+		ReadOnly:         true,
+	}
+	err = os.MkdirAll(settings.CacheDirectory, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(settings.CacheDirectory, "page3"), []byte{}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// volumes without records have been created with 64 MiB pages
+	err = checkMetadata(settings)
+	assert.NotNil(t, err)
+
+	settings.PageSize = legacyPageSize
+	err = checkMetadata(settings)
+	assert.Nil(t, err)
+
+	// nothing is written in read-only mode
+	_, found, err := readMetadata(filepath.Join(settings.CacheDirectory, metadataFile))
+	assert.Nil(t, err)
+	assert.False(t, found)
+	found, err = store.GetMetadata(filepath.Join(dir, "remote"))
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
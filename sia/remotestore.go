@@ -0,0 +1,58 @@
+package sia
+
+type (
+	// RemoteStore is where pages are kept once they leave the cache. Pages
+	// are identified by their number, how they are named is up to the store.
+	RemoteStore interface {
+		// PutPage starts to upload the page from the given file. The
+		// upload may continue in the background; ListPages reports
+		// when it is complete.
+		PutPage(page int, path string) error
+
+		// GetPage downloads the page into the given file. The file only
+		// appears once the download is complete.
+		GetPage(page int, path string) error
+
+		// DeletePage removes the page, together with any upload that is
+		// still in progress. Deleting a page that does not exist is not
+		// an error.
+		DeletePage(page int) error
+
+		// ListPages reports all pages in the store and their health.
+		ListPages() ([]RemotePage, error)
+
+		// PutMetadata stores the metadata record of the volume from the
+		// given file.
+		PutMetadata(path string) error
+
+		// GetMetadata downloads the metadata record of the volume into
+		// the given file. It reports false if there is none.
+		GetMetadata(path string) (bool, error)
+	}
+
+	// PartialRemoteStore is implemented by stores that can update parts of
+	// a page that they already hold, so that unchanged data does not need
+	// to be sent again.
+	PartialRemoteStore interface {
+		RemoteStore
+
+		// PutPageRanges is like PutPage, but only uploads the given
+		// ranges of the file. The rest of the page is kept as it is.
+		PutPageRanges(page int, path string, ranges []PageRange) error
+	}
+
+	// PageRange is a part of a page, relative to its start.
+	PageRange struct {
+		Offset int64
+		Length int64
+	}
+
+	// RemotePage describes the health of a page in a remote store. A page
+	// is recoverable once it can be downloaded in full. The redundancy says
+	// how many times over its data is stored.
+	RemotePage struct {
+		Page        int
+		Recoverable bool
+		Redundancy  float64
+	}
+)
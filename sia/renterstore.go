@@ -0,0 +1,259 @@
+package sia
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/node/api/client"
+
+	"github.com/javgh/sia-nbdserver/config"
+)
+
+type (
+	// RenterStore keeps pages as files of a Sia renter. Each page is stored
+	// as PREFIX/pageN.
+	RenterStore struct {
+		httpClient    *client.Client
+		siaPathPrefix string
+		dataPieces    int
+		parityPieces  int
+	}
+
+	RenterStoreSettings struct {
+		SiaDaemonAddress  string
+		SiaPasswordFile   string
+		SiaPathPrefix     string
+		DataPieces        int
+		ParityPieces      int
+		MinimumRedundancy float64
+	}
+)
+
+const (
+	useCachedRenterInfo = true
+
+	// Sia refuses uploads with fewer parity pieces or less redundancy.
+	renterMinimumParityPieces = 12
+	renterMinimumRedundancy   = 2.0
+)
+
+func NewRenterStore(settings RenterStoreSettings) (*RenterStore, error) {
+	siaPassword, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := client.Client{
+		Address:  settings.SiaDaemonAddress,
+		Password: siaPassword,
+	}
+
+	renter, err := httpClient.RenterGet()
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRenterSettings(settings, renter.Settings.Allowance.Hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RenterStore{
+		httpClient:    &httpClient,
+		siaPathPrefix: settings.SiaPathPrefix,
+		dataPieces:    settings.DataPieces,
+		parityPieces:  settings.ParityPieces,
+	}, nil
+}
+
+// checkRenterSettings makes sure that Sia accepts uploads with the given
+// erasure coding and that the renter has contracts with enough hosts to reach
+// the minimum redundancy. Every piece of a file needs to go to a different
+// host. A renter without an allowance has no hosts yet, so there is nothing
+// to compare against.
+func checkRenterSettings(settings RenterStoreSettings, hosts uint64) error {
+	if settings.ParityPieces < renterMinimumParityPieces {
+		return fmt.Errorf("Sia requires at least %d parity pieces, but %d are configured",
+			renterMinimumParityPieces, settings.ParityPieces)
+	}
+
+	pieces := settings.DataPieces + settings.ParityPieces
+	if float64(pieces)/float64(settings.DataPieces) < renterMinimumRedundancy {
+		return fmt.Errorf("Sia requires a redundancy of at least %.2f, but %d data and"+
+			" %d parity pieces only give %.2f", renterMinimumRedundancy,
+			settings.DataPieces, settings.ParityPieces,
+			float64(pieces)/float64(settings.DataPieces))
+	}
+
+	if hosts == 0 {
+		return nil
+	}
+
+	reachable := float64(min(pieces, int(hosts))) / float64(settings.DataPieces)
+	if reachable < settings.MinimumRedundancy {
+		return fmt.Errorf("minimum redundancy %.2f for %s can not be reached with %d hosts",
+			settings.MinimumRedundancy, settings.SiaPathPrefix, hosts)
+	}
+
+	return nil
+}
+
+func (rs *RenterStore) PutPage(page int, path string) error {
+	siaPath, err := modules.NewSiaPath(asSiaPath(rs.siaPathPrefix, page))
+	if err != nil {
+		return err
+	}
+
+	return rs.httpClient.RenterUploadForcePost(
+		path, siaPath, uint64(rs.dataPieces), uint64(rs.parityPieces), true)
+}
+
+func (rs *RenterStore) GetPage(page int, path string) error {
+	siaPath, err := modules.NewSiaPath(asSiaPath(rs.siaPathPrefix, page))
+	if err != nil {
+		return err
+	}
+
+	// like writeFileAtomically, as siad writes the file itself
+	_, err = rs.httpClient.RenterDownloadFullGet(siaPath, path+downloadSuffix, false)
+	if err != nil {
+		os.Remove(path + downloadSuffix)
+		return err
+	}
+
+	return os.Rename(path+downloadSuffix, path)
+}
+
+func (rs *RenterStore) DeletePage(page int) error {
+	siaPath, err := modules.NewSiaPath(asSiaPath(rs.siaPathPrefix, page))
+	if err != nil {
+		return err
+	}
+
+	err = rs.httpClient.RenterFileDeletePost(siaPath)
+	if err == nil {
+		return nil
+	}
+
+	// A page that has been cached without ever being uploaded has no
+	// copy on Sia, so the deletion is only a failure if the file exists.
+	exists, err2 := rs.fileExists(siaPath)
+	if err2 != nil {
+		return err2
+	}
+
+	if exists {
+		return err
+	}
+	return nil
+}
+
+func (rs *RenterStore) ListPages() ([]RemotePage, error) {
+	pages := []RemotePage{}
+
+	renterFiles, err := rs.httpClient.RenterFilesGet(useCachedRenterInfo)
+	if err != nil {
+		return pages, err
+	}
+
+	for _, fileInfo := range renterFiles.Files {
+		if !isRelevantSiaPath(rs.siaPathPrefix, fileInfo.SiaPath.String()) {
+			continue
+		}
+
+		page, err := getPageFromSiaPath(rs.siaPathPrefix, fileInfo.SiaPath.String())
+		if err != nil {
+			return pages, err
+		}
+
+		pages = append(pages, RemotePage{
+			Page:        page,
+			Recoverable: fileInfo.Available && fileInfo.Recoverable,
+			Redundancy:  fileInfo.Redundancy,
+		})
+	}
+
+	return pages, nil
+}
+
+func (rs *RenterStore) PutMetadata(path string) error {
+	siaPath, err := modules.NewSiaPath(rs.siaPathPrefix + "/" + metadataFile)
+	if err != nil {
+		return err
+	}
+
+	return rs.httpClient.RenterUploadForcePost(
+		path, siaPath, uint64(rs.dataPieces), uint64(rs.parityPieces), true)
+}
+
+func (rs *RenterStore) GetMetadata(path string) (bool, error) {
+	siaPath, err := modules.NewSiaPath(rs.siaPathPrefix + "/" + metadataFile)
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := rs.fileExists(siaPath)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	_, err = rs.httpClient.RenterDownloadFullGet(siaPath, path, false)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (rs *RenterStore) fileExists(siaPath modules.SiaPath) (bool, error) {
+	renterFiles, err := rs.httpClient.RenterFilesGet(useCachedRenterInfo)
+	if err != nil {
+		return false, err
+	}
+
+	for _, fileInfo := range renterFiles.Files {
+		if fileInfo.SiaPath.Equals(siaPath) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func asSiaPath(siaPathPrefix string, page int) string {
+	return fmt.Sprintf("%s/page%d", siaPathPrefix, page)
+}
+
+// isRelevantSiaPath only accepts pages directly below the prefix, as the
+// prefixes of other volumes might be nested inside of it.
+func isRelevantSiaPath(siaPathPrefix string, siaPath string) bool {
+	pagePrefix := fmt.Sprintf("%s/page", siaPathPrefix)
+	if !strings.HasPrefix(siaPath, pagePrefix) {
+		return false
+	}
+
+	number := strings.TrimPrefix(siaPath, pagePrefix)
+	if number == "" {
+		return false
+	}
+
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func getPageFromSiaPath(siaPathPrefix string, siaPath string) (int, error) {
+	var page int
+
+	format := fmt.Sprintf("%s/page%%d", siaPathPrefix)
+	_, err := fmt.Sscanf(siaPath, format, &page)
+	if err != nil {
+		return 0, err
+	}
+
+	return page, nil
+}
@@ -0,0 +1,44 @@
+package sia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRelevantSiaPath(t *testing.T) {
+	assert.True(t, isRelevantSiaPath("nbd", "nbd/page0"))
+	assert.True(t, isRelevantSiaPath("nbd", "nbd/page123"))
+	assert.True(t, isRelevantSiaPath("nbd/page", "nbd/page/page7"))
+	assert.False(t, isRelevantSiaPath("nbd", "nbd/page"))
+	assert.False(t, isRelevantSiaPath("nbd", "nbd/page/page7"))
+	assert.False(t, isRelevantSiaPath("nbd", "nbd/other/page7"))
+	assert.False(t, isRelevantSiaPath("nbd", "nbd2/page7"))
+}
+
+func TestGetPageFromSiaPath(t *testing.T) {
+	page, err := getPageFromSiaPath("nbd/page", "nbd/page/page7")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, page)
+}
+
+func TestCheckRenterSettings(t *testing.T) {
+	settings := RenterStoreSettings{
+		SiaPathPrefix:     "nbd",
+		DataPieces:        10,
+		ParityPieces:      20,
+		MinimumRedundancy: 2.5,
+	}
+	assert.Nil(t, checkRenterSettings(settings, 50))
+	assert.Nil(t, checkRenterSettings(settings, 25))
+	assert.Nil(t, checkRenterSettings(settings, 0))
+	assert.NotNil(t, checkRenterSettings(settings, 24))
+
+	settings.ParityPieces = 10
+	assert.NotNil(t, checkRenterSettings(settings, 50))
+
+	settings.DataPieces = 20
+	settings.ParityPieces = 12
+	settings.MinimumRedundancy = 1.5
+	assert.NotNil(t, checkRenterSettings(settings, 50))
+}
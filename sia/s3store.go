@@ -0,0 +1,469 @@
+package sia
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// S3Store keeps pages as objects PREFIX/pageN in a bucket of an
+	// S3-compatible object storage. Requests are signed with AWS Signature
+	// Version 4 and use path-style addressing, which works with most
+	// implementations.
+	S3Store struct {
+		endpoint   *url.URL
+		bucket     string
+		region     string
+		accessKey  string
+		secretKey  string
+		prefix     string
+		httpClient *http.Client
+		now        func() time.Time
+
+		mutex   *sync.Mutex
+		uploads map[int]*s3Upload
+	}
+
+	S3StoreSettings struct {
+		Endpoint        string
+		Bucket          string
+		Region          string
+		AccessKeyID     string
+		SecretAccessKey string
+		Prefix          string
+	}
+
+	// s3Upload is an upload that runs in the background. It is retried
+	// until it succeeds or is cancelled.
+	s3Upload struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+
+	s3Payload struct {
+		body *os.File
+		hash string
+	}
+
+	s3ListBucketResult struct {
+		Contents []struct {
+			Key string
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	// s3Error is a response other than 2xx, together with the error
+	// details that S3 sends in the body.
+	s3Error struct {
+		Code    string
+		Message string
+
+		statusCode int
+		status     string
+		method     string
+		path       string
+	}
+)
+
+const (
+	s3RetryInterval = 30 * time.Second
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+
+	// emptyPayloadHash is the SHA-256 hash of an empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func NewS3Store(settings S3StoreSettings) (*S3Store, error) {
+	endpoint, err := url.Parse(settings.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("S3 endpoint %s is not a http or https URL", settings.Endpoint)
+	}
+
+	if settings.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+
+	return &S3Store{
+		endpoint:   endpoint,
+		bucket:     settings.Bucket,
+		region:     settings.Region,
+		accessKey:  settings.AccessKeyID,
+		secretKey:  settings.SecretAccessKey,
+		prefix:     settings.Prefix,
+		httpClient: &http.Client{},
+		now:        time.Now,
+		mutex:      &sync.Mutex{},
+		uploads:    map[int]*s3Upload{},
+	}, nil
+}
+
+// PutPage uploads the page in the background, just like the Sia renter
+// does. Until the upload has completed, ListPages reports the page with a
+// redundancy of zero, so that an older copy is not mistaken for it.
+func (s *S3Store) PutPage(page int, path string) error {
+	s.cancelUpload(page)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upload := &s3Upload{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	s.mutex.Lock()
+	s.uploads[page] = upload
+	s.mutex.Unlock()
+
+	go func() {
+		defer close(upload.done)
+
+		for {
+			err := s.putObject(ctx, asSiaPath(s.prefix, page), path)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+
+			log.Printf("Error while uploading page %d to S3: %s", page, err)
+			select {
+			case <-time.After(s3RetryInterval):
+			case <-ctx.Done():
+			}
+		}
+
+		s.mutex.Lock()
+		if s.uploads[page] == upload {
+			delete(s.uploads, page)
+		}
+		s.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+func (s *S3Store) GetPage(page int, path string) error {
+	response, err := s.request(context.Background(), http.MethodGet,
+		asSiaPath(s.prefix, page), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return writeFileAtomically(path, response.Body)
+}
+
+// DeletePage waits for a cancelled upload to stop before the object is
+// deleted, so that the upload can not recreate it afterwards.
+func (s *S3Store) DeletePage(page int) error {
+	s.cancelUpload(page)
+
+	response, err := s.request(context.Background(), http.MethodDelete,
+		asSiaPath(s.prefix, page), nil, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// ListPages reports objects with an infinite redundancy, as S3 takes care of
+// durability itself and does not reveal how.
+func (s *S3Store) ListPages() ([]RemotePage, error) {
+	pages := []RemotePage{}
+
+	keys, err := s.listObjects(s.prefix + "/page")
+	if err != nil {
+		return pages, err
+	}
+
+	// Only look at uploads in progress now, as an upload that completed
+	// in the meantime is already part of the listing.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		if !isRelevantSiaPath(s.prefix, key) {
+			continue
+		}
+
+		page, err := getPageFromSiaPath(s.prefix, key)
+		if err != nil {
+			return pages, err
+		}
+
+		redundancy := math.Inf(1)
+		if _, ok := s.uploads[page]; ok {
+			redundancy = 0
+		}
+
+		pages = append(pages, RemotePage{
+			Page:        page,
+			Recoverable: true,
+			Redundancy:  redundancy,
+		})
+	}
+
+	return pages, nil
+}
+
+func (s *S3Store) PutMetadata(path string) error {
+	return s.putObject(context.Background(), s.prefix+"/"+metadataFile, path)
+}
+
+func (s *S3Store) GetMetadata(path string) (bool, error) {
+	response, err := s.request(context.Background(), http.MethodGet,
+		s.prefix+"/"+metadataFile, nil, nil)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.statusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	err = writeFile(path, response.Body)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Store) cancelUpload(page int) {
+	s.mutex.Lock()
+	upload, ok := s.uploads[page]
+	delete(s.uploads, page)
+	s.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	upload.cancel()
+	<-upload.done
+}
+
+func (s *S3Store) putObject(ctx context.Context, key string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.request(ctx, http.MethodPut, key, nil, &s3Payload{
+		body: file,
+		hash: hex.EncodeToString(hash.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (s *S3Store) listObjects(prefix string) ([]string, error) {
+	keys := []string{}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	for {
+		response, err := s.request(context.Background(), http.MethodGet, "", query, nil)
+		if err != nil {
+			return keys, err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return keys, err
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// request sends a signed request for the given key of the bucket. Responses
+// other than 2xx are turned into an error.
+func (s *S3Store) request(ctx context.Context, method string, key string,
+	query url.Values, payload *s3Payload) (*http.Response, error) {
+	requestURL := *s.endpoint
+	requestURL.Path = strings.TrimSuffix(requestURL.Path, "/") + "/" + s.bucket
+	if key != "" {
+		requestURL.Path += "/" + key
+	}
+	requestURL.RawQuery = ""
+	if query != nil {
+		requestURL.RawQuery = query.Encode()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash := emptyPayloadHash
+	if payload != nil {
+		info, err := payload.body.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		request.Body = ioutil.NopCloser(payload.body)
+		request.ContentLength = info.Size()
+		payloadHash = payload.hash
+	}
+
+	signRequest(request, payloadHash, s.accessKey, s.secretKey, s.region, s.now())
+
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	s3Err := s3Error{
+		statusCode: response.StatusCode,
+		status:     response.Status,
+		method:     method,
+		path:       requestURL.Path,
+	}
+	xml.NewDecoder(response.Body).Decode(&s3Err)
+	return nil, &s3Err
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request %s %s failed: %s", e.method, e.path, e.status)
+	}
+	return fmt.Sprintf("S3 request %s %s failed: %s: %s", e.method, e.path, e.Code, e.Message)
+}
+
+// signRequest adds an AWS Signature Version 4 to the request. All headers
+// that are set at this point are signed, together with the host.
+func signRequest(request *http.Request, payloadHash string, accessKey string,
+	secretKey string, region string, now time.Time) {
+	now = now.UTC()
+	request.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		uriEncode(request.URL.Path, false),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), region, s3Service, "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	parameters := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			parameters = append(parameters, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(parameters)
+	return strings.Join(parameters, "&")
+}
+
+// uriEncode escapes everything except the unreserved characters, as required
+// by the signature. Slashes are only escaped in query parameters.
+func uriEncode(s string, encodeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(s) {
+		unreserved := (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') ||
+			(b >= '0' && b <= '9') || b == '-' || b == '.' || b == '_' || b == '~'
+		if unreserved || (b == '/' && !encodeSlash) {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}